@@ -0,0 +1,108 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/krm-functions/catalog/pkg/util"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const dockerConfigJSONKey = ".dockerconfigjson"
+
+// registryKeychain resolves credentials per registry host
+type registryKeychain map[string]authn.AuthConfig
+
+func (k registryKeychain) Resolve(resource authn.Resource) (authn.Authenticator, error) {
+	if cfg, found := k[normalizeRegistryHost(resource.RegistryStr())]; found {
+		return authn.FromConfig(cfg), nil
+	}
+	return authn.Anonymous, nil
+}
+
+// dockerConfig is the format of '.dockerconfigjson' in Secrets of type 'kubernetes.io/dockerconfigjson'
+type dockerConfig struct {
+	Auths map[string]authn.AuthConfig `json:"auths"`
+}
+
+// NewKeychain creates a keychain from the Secrets referenced in
+// function config. Secrets are read from items
+func NewKeychain(auths []RegistryAuth, items []*yaml.RNode) (authn.Keychain, error) {
+	keychain := registryKeychain{}
+	if len(auths) == 0 {
+		return keychain, nil
+	}
+	rl := &fn.ResourceList{}
+	for _, item := range items {
+		if item.GetApiVersion() != "v1" || item.GetKind() != "Secret" {
+			continue
+		}
+		o, err := fn.ParseKubeObject([]byte(item.MustString()))
+		if err != nil {
+			return nil, err
+		}
+		rl.Items = append(rl.Items, o)
+	}
+	for idx := range auths {
+		a := &auths[idx]
+		if a.Registry != "" {
+			username, password, err := util.LookupAuthSecretWithKeys(a.Name, a.Namespace, a.UsernameKey, a.PasswordKey, rl)
+			if err != nil {
+				return nil, err
+			}
+			keychain[normalizeRegistryHost(a.Registry)] = authn.AuthConfig{Username: username, Password: password}
+			continue
+		}
+		// Docker config Secrets holds a JSON document, which we read as 'password' with an unused 'username'
+		_, config, err := util.LookupAuthSecretWithKeys(a.Name, a.Namespace, dockerConfigJSONKey, dockerConfigJSONKey, rl)
+		if err != nil {
+			return nil, err
+		}
+		if err = keychain.addDockerConfig([]byte(config)); err != nil {
+			return nil, fmt.Errorf("parsing docker config in Secret %s/%s: %w", a.Namespace, a.Name, err)
+		}
+	}
+	return keychain, nil
+}
+
+func (k registryKeychain) addDockerConfig(data []byte) error {
+	cfg := dockerConfig{}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return err
+	}
+	// The 'auth' field is decoded into username and password by AuthConfig
+	for host, auth := range cfg.Auths {
+		k[normalizeRegistryHost(host)] = auth
+	}
+	return nil
+}
+
+// normalizeRegistryHost strips scheme and path from registry hosts
+// such as 'https://index.docker.io/v1/' and maps Docker Hub aliases to
+// the canonical Docker Hub host
+func normalizeRegistryHost(host string) string {
+	host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+	host, _, _ = strings.Cut(host, "/")
+	if host == "docker.io" || host == "registry-1.docker.io" {
+		return name.DefaultRegistry
+	}
+	return host
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/krm-functions/catalog/pkg/helm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewKeychain(t *testing.T) {
+	// .dockerconfigjson: {"auths":{"https://index.docker.io/v1/":{"auth":"ZG9ja2VyOmh1Yg=="},"registry.example.com":{"username":"foo","password":"bar"}}}
+	input := `apiVersion: v1
+kind: Secret
+metadata:
+  name: regcred
+  namespace: default
+type: kubernetes.io/dockerconfigjson
+data:
+  .dockerconfigjson: eyJhdXRocyI6eyJodHRwczovL2luZGV4LmRvY2tlci5pby92MS8iOnsiYXV0aCI6IlpHOWphMlZ5T21oMVlnPT0ifSwicmVnaXN0cnkuZXhhbXBsZS5jb20iOnsidXNlcm5hbWUiOiJmb28iLCJwYXNzd29yZCI6ImJhciJ9fX0=
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: ghcr
+  namespace: ci
+data:
+  user: Z2g=
+  token: c2VjcmV0
+`
+	items, err := helm.ParseAsRNodes([]byte(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keychain, err := NewKeychain([]RegistryAuth{
+		{Name: "regcred"},
+		{Name: "ghcr", Namespace: "ci", Registry: "ghcr.io", UsernameKey: "user", PasswordKey: "token"},
+	}, items)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertAuth := func(image string, want *authn.AuthConfig) {
+		t.Helper()
+		ref, err := name.ParseReference(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth, err := keychain.Resolve(ref.Context())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := auth.Authorization()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, want.Username, cfg.Username)
+		assert.Equal(t, want.Password, cfg.Password)
+	}
+	assertAuth("nginx:1.27", &authn.AuthConfig{Username: "docker", Password: "hub"})
+	assertAuth("registry.example.com/app:1.0", &authn.AuthConfig{Username: "foo", Password: "bar"})
+	assertAuth("ghcr.io/org/app:1.0", &authn.AuthConfig{Username: "gh", Password: "secret"})
+	assertAuth("quay.io/org/app:1.0", &authn.AuthConfig{})
+
+	_, err = NewKeychain([]RegistryAuth{{Name: "missing"}}, items)
+	assert.Error(t, err)
+}
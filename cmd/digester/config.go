@@ -0,0 +1,279 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+const (
+	// Fail the function on unresolved images and unmatched patterns
+	FailPolicyFail = "fail"
+	// Report unresolved images and unmatched patterns as warnings, and clear digests of unresolved images
+	FailPolicyWarn = "warn"
+	// Keep existing digests of unresolved images, reported as info
+	FailPolicyKeepExisting = "keep-existing"
+)
+
+const (
+	// Look up digests in lock and OCI layout first, then in registries
+	LookupModeOnline = "online"
+	// Look up digests in lock and OCI layout only
+	LookupModeOffline = "offline"
+	// Look up digests in OCI layout and registries and write them to the lock
+	LookupModeRefreshLock = "refresh-lock"
+)
+
+const (
+	// Fail the function on images without a valid signature
+	VerifyModeFail = "fail"
+	// Annotate RenderHelmChart resources with signature verification results
+	VerifyModeAnnotate = "annotate"
+)
+
+// FunctionConfig is the digester function config, given as a
+// 'Digester' resource of apiVersion 'fn.kpt.dev/v1alpha1'
+type FunctionConfig struct {
+	// Additional paths of fields holding images
+	ImagePaths []ImagePath `json:"imagePaths,omitempty" yaml:"imagePaths,omitempty"`
+	// Additional paths of objects holding images split into repository and tag fields
+	ImageRepoTagPaths []ImageRepoTagPath `json:"imageRepoTagPaths,omitempty" yaml:"imageRepoTagPaths,omitempty"`
+	// Mapping from images to chart values holding digest, tag and repository
+	ImageValues []ImageValues `json:"imageValues,omitempty" yaml:"imageValues,omitempty"`
+	// Set values marked with '# digester: <regexp>' comments. Default true
+	CommentMarkers *bool `json:"commentMarkers,omitempty" yaml:"commentMarkers,omitempty"`
+	// Image tag upgrades
+	ImageUpgrades []ImageUpgrade `json:"imageUpgrades,omitempty" yaml:"imageUpgrades,omitempty"`
+	// Pin images with digests directly in resources, i.e. not only through RenderHelmChart values
+	PinManifests bool `json:"pinManifests,omitempty" yaml:"pinManifests,omitempty"`
+	// Regular expressions selecting images to pin in resources. All images if empty
+	Include []string `json:"include,omitempty" yaml:"include,omitempty"`
+	// Regular expressions selecting images not to pin in resources
+	Exclude []string `json:"exclude,omitempty" yaml:"exclude,omitempty"`
+	// Platform to pin, e.g. 'linux/arm64'. If empty, the digest of the multi-platform image index is used
+	Platform string `json:"platform,omitempty" yaml:"platform,omitempty"`
+	// Policy for images that cannot be resolved and '# digester:' patterns matching no images. Default 'warn'
+	FailPolicy string `json:"failPolicy,omitempty" yaml:"failPolicy,omitempty"`
+	// Maximum number of concurrent digest lookups. Default 8
+	Concurrency int `json:"concurrency,omitempty" yaml:"concurrency,omitempty"`
+	// Maximum number of digest lookups per second per registry. Default 10, no limit if negative
+	RateLimit int `json:"rateLimit,omitempty" yaml:"rateLimit,omitempty"`
+	// Number of retries of lookups failing with status 429 or 5xx. Default 3, zero disables retries
+	Retries *int `json:"retries,omitempty" yaml:"retries,omitempty"`
+	// Source of digests, one of 'online', 'offline' and 'refresh-lock'. Default 'online'
+	LookupMode string `json:"lookupMode,omitempty" yaml:"lookupMode,omitempty"`
+	// Path of OCI image layout directory to look up digests in before registries
+	OCILayout string `json:"ociLayout,omitempty" yaml:"ociLayout,omitempty"`
+	// Verification of image signatures. No verification if nil
+	VerifySignatures *SignatureVerification `json:"verifySignatures,omitempty" yaml:"verifySignatures,omitempty"`
+	// Secrets with registry credentials
+	RegistryAuth []RegistryAuth `json:"registryAuth,omitempty" yaml:"registryAuth,omitempty"`
+}
+
+// SignatureVerification configures verification of cosign image signatures
+type SignatureVerification struct {
+	PublicKey PublicKeyRef `json:"publicKey,omitempty" yaml:"publicKey,omitempty"`
+	// Handling of images without valid signature, 'fail' or 'annotate'. Default 'fail'
+	Mode string `json:"mode,omitempty" yaml:"mode,omitempty"`
+}
+
+// PublicKeyRef references a PEM encoded public key in a ConfigMap or Secret
+type PublicKeyRef struct {
+	Kind      string `json:"kind,omitempty" yaml:"kind,omitempty"`
+	Name      string `json:"name,omitempty" yaml:"name,omitempty"`
+	Namespace string `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+	// Key in data holding the public key. Default 'cosign.pub'
+	Key string `json:"key,omitempty" yaml:"key,omitempty"`
+}
+
+// RegistryAuth references a Secret with registry credentials. Secrets
+// of type 'kubernetes.io/dockerconfigjson' holds credentials for
+// registries listed in the docker config. Other Secrets holds a
+// username and password for a single registry
+type RegistryAuth struct {
+	Name      string `json:"name,omitempty" yaml:"name,omitempty"`
+	Namespace string `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+	// Registry host the username and password applies to, e.g. 'ghcr.io'. Must be empty for docker config Secrets
+	Registry    string `json:"registry,omitempty" yaml:"registry,omitempty"`
+	UsernameKey string `json:"usernameKey,omitempty" yaml:"usernameKey,omitempty"`
+	PasswordKey string `json:"passwordKey,omitempty" yaml:"passwordKey,omitempty"`
+}
+
+// ImagePath identifies fields holding images
+type ImagePath struct {
+	// Regular expression matched against field paths, e.g. '\.spec\.image$'
+	Path string `json:"path,omitempty" yaml:"path,omitempty"`
+	// Kinds the path applies to, e.g. 'Prometheus' or 'monitoring.coreos.com/Prometheus'. All kinds if empty
+	Kinds []string `json:"kinds,omitempty" yaml:"kinds,omitempty"`
+}
+
+// ImageValues maps images of RenderHelmChart charts to values paths,
+// e.g. 'controller.image.digest'. Values are set in 'valuesInline'
+type ImageValues struct {
+	// Regular expression matched against images, e.g. 'quay.io/jetstack/cert-manager-controller:.*'
+	Image string `json:"image,omitempty" yaml:"image,omitempty"`
+	// Name of chart the mapping applies to. All charts if empty
+	Chart      string `json:"chart,omitempty" yaml:"chart,omitempty"`
+	Digest     string `json:"digest,omitempty" yaml:"digest,omitempty"`
+	Tag        string `json:"tag,omitempty" yaml:"tag,omitempty"`
+	Repository string `json:"repository,omitempty" yaml:"repository,omitempty"`
+}
+
+// ImageUpgrade upgrades tags of images to the highest tag satisfying a semver constraint
+type ImageUpgrade struct {
+	// Regular expression matched against images, e.g. '^ghcr.io/example/app:'
+	Image string `json:"image,omitempty" yaml:"image,omitempty"`
+	// Semver constraint, e.g. '~1.4'
+	Constraint string `json:"constraint,omitempty" yaml:"constraint,omitempty"`
+}
+
+// ImageRepoTagPath identifies objects holding images in separate fields
+type ImageRepoTagPath struct {
+	// Regular expression matched against the path of the object holding the fields, e.g. '\.spec\.image$'
+	Path  string   `json:"path,omitempty" yaml:"path,omitempty"`
+	Kinds []string `json:"kinds,omitempty" yaml:"kinds,omitempty"`
+	// Optional field with registry, prefixed to the repository
+	Registry   string `json:"registry,omitempty" yaml:"registry,omitempty"`
+	Repository string `json:"repository,omitempty" yaml:"repository,omitempty"`
+	Tag        string `json:"tag,omitempty" yaml:"tag,omitempty"`
+}
+
+func (fnCfg *FunctionConfig) Default() error { //nolint:unparam // this return is part of the Defaulter interface
+	if fnCfg.FailPolicy == "" {
+		fnCfg.FailPolicy = FailPolicyWarn
+	}
+	if fnCfg.CommentMarkers == nil {
+		enabled := true
+		fnCfg.CommentMarkers = &enabled
+	}
+	if fnCfg.LookupMode == "" {
+		fnCfg.LookupMode = LookupModeOnline
+	}
+	if v := fnCfg.VerifySignatures; v != nil {
+		if v.Mode == "" {
+			v.Mode = VerifyModeFail
+		}
+		if v.PublicKey.Kind == "" {
+			v.PublicKey.Kind = "ConfigMap"
+		}
+		if v.PublicKey.Key == "" {
+			v.PublicKey.Key = "cosign.pub"
+		}
+	}
+	if fnCfg.Concurrency == 0 {
+		fnCfg.Concurrency = 8
+	}
+	if fnCfg.RateLimit == 0 {
+		fnCfg.RateLimit = 10
+	}
+	if fnCfg.Retries == nil {
+		retries := 3
+		fnCfg.Retries = &retries
+	}
+	for idx := range fnCfg.RegistryAuth {
+		a := &fnCfg.RegistryAuth[idx]
+		if a.UsernameKey == "" {
+			a.UsernameKey = "username"
+		}
+		if a.PasswordKey == "" {
+			a.PasswordKey = "password"
+		}
+	}
+	for idx := range fnCfg.ImageRepoTagPaths {
+		p := &fnCfg.ImageRepoTagPaths[idx]
+		if p.Repository == "" {
+			p.Repository = "repository"
+		}
+		if p.Tag == "" {
+			p.Tag = "tag"
+		}
+	}
+	return nil
+}
+
+func (fnCfg *FunctionConfig) Validate() error {
+	switch fnCfg.FailPolicy {
+	case FailPolicyFail, FailPolicyWarn, FailPolicyKeepExisting:
+	default:
+		return fmt.Errorf("invalid failPolicy %q", fnCfg.FailPolicy)
+	}
+	for _, p := range fnCfg.ImagePaths {
+		if _, err := regexp.Compile(p.Path); err != nil {
+			return fmt.Errorf("invalid image path %q: %w", p.Path, err)
+		}
+	}
+	if fnCfg.Platform != "" {
+		if _, err := v1.ParsePlatform(fnCfg.Platform); err != nil {
+			return fmt.Errorf("invalid platform %q: %w", fnCfg.Platform, err)
+		}
+	}
+	for _, v := range fnCfg.ImageValues {
+		if _, err := regexp.Compile(v.Image); err != nil {
+			return fmt.Errorf("invalid image values pattern %q: %w", v.Image, err)
+		}
+		if v.Digest == "" && v.Tag == "" && v.Repository == "" {
+			return fmt.Errorf("image values %q: at least one of digest, tag and repository required", v.Image)
+		}
+	}
+	for _, u := range fnCfg.ImageUpgrades {
+		if _, err := regexp.Compile(u.Image); err != nil {
+			return fmt.Errorf("invalid image upgrade pattern %q: %w", u.Image, err)
+		}
+		if u.Constraint == "" {
+			return fmt.Errorf("image upgrade %q: constraint required", u.Image)
+		}
+	}
+	switch fnCfg.LookupMode {
+	case LookupModeOnline, LookupModeOffline, LookupModeRefreshLock:
+	default:
+		return fmt.Errorf("invalid lookupMode %q", fnCfg.LookupMode)
+	}
+	if v := fnCfg.VerifySignatures; v != nil {
+		if v.Mode != VerifyModeFail && v.Mode != VerifyModeAnnotate {
+			return fmt.Errorf("invalid signature verification mode %q", v.Mode)
+		}
+		if v.PublicKey.Kind != "ConfigMap" && v.PublicKey.Kind != "Secret" {
+			return fmt.Errorf("public key must be in a ConfigMap or Secret, got %q", v.PublicKey.Kind)
+		}
+		if v.PublicKey.Name == "" {
+			return fmt.Errorf("public key name required")
+		}
+	}
+	if fnCfg.Concurrency < 1 {
+		return fmt.Errorf("invalid concurrency %d", fnCfg.Concurrency)
+	}
+	if fnCfg.Retries != nil && *fnCfg.Retries < 0 {
+		return fmt.Errorf("invalid retries %d", *fnCfg.Retries)
+	}
+	for _, a := range fnCfg.RegistryAuth {
+		if a.Name == "" {
+			return fmt.Errorf("registry auth Secret name required")
+		}
+	}
+	for _, p := range append(fnCfg.Include, fnCfg.Exclude...) {
+		if _, err := regexp.Compile(p); err != nil {
+			return fmt.Errorf("invalid include/exclude pattern %q: %w", p, err)
+		}
+	}
+	for _, p := range fnCfg.ImageRepoTagPaths {
+		if _, err := regexp.Compile(p.Path); err != nil {
+			return fmt.Errorf("invalid image repository/tag path %q: %w", p.Path, err)
+		}
+	}
+	return nil
+}
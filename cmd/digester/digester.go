@@ -17,10 +17,20 @@ package main
 import (
 	"encoding/base64"
 	"fmt"
+	"maps"
+	"net/http"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
 	"github.com/krm-functions/catalog/pkg/api"
 	"github.com/krm-functions/catalog/pkg/helm"
 	t "github.com/krm-functions/catalog/pkg/helmspecs"
@@ -30,11 +40,54 @@ import (
 )
 
 const (
-	containerImagePathFilter     = `.*containers\[\d+\].image$`
-	initContainerImagePathFilter = `.*initContainers\[\d+\].image$`
-	digesterRegexpPrefix         = `# digester: `
+	digesterRegexpPrefix = `# digester: `
 )
 
+var (
+	// Status codes of registry responses for which lookups are retried
+	retryStatusCodes = []int{
+		http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+	}
+	tektonKinds       = []string{"tekton.dev/Task", "tekton.dev/ClusterTask", "tekton.dev/Pipeline", "tekton.dev/TaskRun", "tekton.dev/PipelineRun"}
+	argoWorkflowKinds = []string{"argoproj.io/Workflow", "argoproj.io/WorkflowTemplate", "argoproj.io/ClusterWorkflowTemplate", "argoproj.io/CronWorkflow"}
+	prometheusKinds   = []string{"monitoring.coreos.com/Prometheus", "monitoring.coreos.com/PrometheusAgent", "monitoring.coreos.com/Alertmanager", "monitoring.coreos.com/ThanosRuler"}
+)
+
+// Catalog of well-known image fields. Pod templates of e.g. Argo
+// Rollouts and Knative Services are covered by the generic container paths
+var builtinImagePaths = []ImagePath{
+	{Path: `.*containers\[\d+\].image$`},
+	{Path: `.*initContainers\[\d+\].image$`},
+	{Path: `.*ephemeralContainers\[\d+\].image$`},
+	{Path: `.*\.(steps|sidecars)\[\d+\]\.image$`, Kinds: tektonKinds},
+	{Path: `.*\.stepTemplate\.image$`, Kinds: tektonKinds},
+	{Path: `.*\.templates\[\d+\]\.(container|script)\.image$`, Kinds: argoWorkflowKinds},
+	{Path: `^\.spec\.image$`, Kinds: prometheusKinds},
+}
+
+// Catalog of well-known objects with images split into repository and tag fields
+var builtinImageRepoTagPaths = []ImageRepoTagPath{
+	{Path: `^\.spec\.image$`, Repository: "repository", Tag: "tag"},
+}
+
+type PathFilter struct {
+	Path *regexp.Regexp
+	// Kinds, optionally with group, e.g. 'monitoring.coreos.com/Prometheus'. All kinds if empty
+	Kinds []string
+}
+
+type RepoTagFilter struct {
+	PathFilter
+	Registry   string
+	Repository string
+	Tag        string
+}
+
 type ImageFilter struct {
 	// List of images found walking resources
 	Images []string
@@ -42,76 +95,404 @@ type ImageFilter struct {
 	// Map from image (key) to digest (value)
 	Digests map[string]string
 
-	// Regular expressions used to identify images
-	PathFilters []*regexp.Regexp
+	// Map from image (key) to platforms available (value)
+	Platforms map[string][]string
+
+	// Map from image (key) to lookup error (value) for unresolved images
+	Errors map[string]error
+
+	// Map from image (key) to tag upgrade (value)
+	Upgrades map[string]UpgradeInfo
+
+	// Map from image (key) to tag upgrade error (value)
+	UpgradeErrors map[string]error
+
+	// Map from image (key) to signature verification error (value). Nil errors for verified images
+	Signatures map[string]error
+
+	// Map from image (key) to predicate types of verified attestations (value)
+	Attestations map[string][]string
+
+	// '# digester:' patterns not matching any image
+	Unmatched []string
+	// '# digester:' patterns and image value mappings matching an
+	// unresolved image, for which the existing digest was cleared
+	Cleared []string
+
+	// Filters used to identify images
+	PathFilters []PathFilter
+
+	// Filters used to identify images split into repository and tag
+	RepoTagFilters []RepoTagFilter
+
+	// Function config
+	Config *FunctionConfig
+
+	// Keychain used for registry lookups. Anonymous if nil
+	Keychain authn.Keychain
+
+	// Digests from lock resource, looked up before any other source
+	Lock map[string]string
+
+	// OCI image layout, looked up before registries
+	Layout *ociLayout
+
+	// Group and kind of the object currently being walked
+	group, kind string
+
+	// Guards maps updated during concurrent lookups
+	mu sync.Mutex
+
+	// Images per chart of the RenderHelmChart resource being processed
+	charts []chartImageList
 }
 
 func NewImageFilter() *ImageFilter {
 	i := &ImageFilter{}
-	i.PathFilters = append(i.PathFilters, regexp.MustCompile(containerImagePathFilter), regexp.MustCompile(initContainerImagePathFilter))
 	i.Digests = make(map[string]string)
+	i.Platforms = make(map[string][]string)
+	i.Errors = make(map[string]error)
+	i.Signatures = make(map[string]error)
+	i.Attestations = make(map[string][]string)
+	i.Upgrades = make(map[string]UpgradeInfo)
+	i.UpgradeErrors = make(map[string]error)
+	// Built-in paths are known to compile
+	_ = i.AddPathFilters(builtinImagePaths, builtinImageRepoTagPaths)
 	return i
 }
 
+// NewImageFilterFromConfig returns an image filter using built-in paths and paths from function config
+func NewImageFilterFromConfig(cfg *FunctionConfig) (*ImageFilter, error) {
+	i := NewImageFilter()
+	i.Config = cfg
+	if cfg == nil {
+		return i, nil
+	}
+	if err := i.AddPathFilters(cfg.ImagePaths, cfg.ImageRepoTagPaths); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+func (i *ImageFilter) AddPathFilters(paths []ImagePath, repoTagPaths []ImageRepoTagPath) error {
+	for _, p := range paths {
+		re, err := regexp.Compile(p.Path)
+		if err != nil {
+			return fmt.Errorf("cannot parse regexp: %v: %w", p.Path, err)
+		}
+		i.PathFilters = append(i.PathFilters, PathFilter{Path: re, Kinds: p.Kinds})
+	}
+	for _, p := range repoTagPaths {
+		re, err := regexp.Compile(p.Path)
+		if err != nil {
+			return fmt.Errorf("cannot parse regexp: %v: %w", p.Path, err)
+		}
+		i.RepoTagFilters = append(i.RepoTagFilters, RepoTagFilter{
+			PathFilter: PathFilter{Path: re, Kinds: p.Kinds},
+			Registry:   p.Registry,
+			Repository: p.Repository,
+			Tag:        p.Tag,
+		})
+	}
+	return nil
+}
+
 func (i *ImageFilter) Process(resourceList *framework.ResourceList) error {
+	if i.Config == nil {
+		i.Config = &FunctionConfig{}
+		if resourceList.FunctionConfig != nil {
+			if err := framework.LoadFunctionConfig(resourceList.FunctionConfig, i.Config); err != nil {
+				return fmt.Errorf("reading function-config: %w", err)
+			}
+		} else {
+			_ = i.Config.Default()
+		}
+	}
+	if i.Keychain == nil {
+		keychain, err := NewKeychain(i.Config.RegistryAuth, resourceList.Items)
+		if err != nil {
+			return fmt.Errorf("reading registry auth: %w", err)
+		}
+		i.Keychain = keychain
+	}
+	if err := i.loadOfflineSources(resourceList.Items); err != nil {
+		return err
+	}
 	results := []*framework.Result{}
 	results = append(results, &framework.Result{
 		Message: "digester",
 	})
+
+	// Collect images from all charts and manifests before looking up
+	// digests, such that each image is only looked up once
+	type chartImages struct {
+		obj    *yaml.RNode
+		filter *ImageFilter
+	}
+	var charts []chartImages
+	cluster, err := lookupCluster(resourceList.Items)
+	if err != nil {
+		return err
+	}
+	if cluster != nil {
+		defer cluster.Close()
+	}
+	profile, err := clusterProfile(resourceList.Items)
+	if err != nil {
+		return err
+	}
 	for _, iobj := range resourceList.Items {
 		if iobj.GetApiVersion() != api.HelmResourceAPIVersion || iobj.GetKind() != "RenderHelmChart" {
 			continue
 		}
-		y := iobj.MustString()
-		spec, err := t.ParseKptSpec([]byte(y))
+		imageFilter, err := i.chartImages(iobj, cluster, profile)
 		if err != nil {
 			return err
 		}
-		for idx := range spec.Charts {
-			if spec.Charts[idx].Options.ReleaseName == "" {
-				return fmt.Errorf("invalid chart spec %s: ReleaseName required, index %d", iobj.GetName(), idx)
-			}
+		charts = append(charts, chartImages{iobj, imageFilter})
+		i.Images = append(i.Images, imageFilter.Images...)
+	}
+	var pinFilter *ImageFilter
+	var manifests []*yaml.RNode
+	if i.Config.PinManifests || len(i.Config.ImageUpgrades) > 0 {
+		var err error
+		pinFilter, manifests, err = i.manifestImages(resourceList.Items)
+		if err != nil {
+			return err
 		}
-		for idx := range spec.Charts {
-			chartTarball, err := base64.StdEncoding.DecodeString(spec.Charts[idx].Chart)
-			if err != nil {
-				return err
-			}
-			if len(chartTarball) == 0 {
-				return fmt.Errorf("no embedded chart found")
-			}
-			rendered, err := helm.Template(&spec.Charts[idx], chartTarball)
+		i.Images = append(i.Images, pinFilter.Images...)
+	}
+	if err := i.LookupUpgrades(); err != nil {
+		return err
+	}
+	i.LookupDigests()
+	if i.Config.LookupMode == LookupModeRefreshLock {
+		var err error
+		resourceList.Items, err = writeDigestLock(resourceList.Items, i.Digests)
+		if err != nil {
+			return err
+		}
+	}
+
+	verify := i.Config.VerifySignatures
+	if verify != nil {
+		if err := i.VerifySignatures(resourceList.Items); err != nil {
+			return err
+		}
+	}
+
+	failures, unverified := 0, 0
+	for _, c := range charts {
+		c.filter.useLookups(i)
+		results = append(results, c.filter.ImageResults()...)
+		results = append(results, c.filter.UpgradeResults()...)
+		if i.Config.CommentMarkers == nil || *i.Config.CommentMarkers {
+			_, err := c.filter.SetDigests(c.obj)
 			if err != nil {
 				return err
 			}
-			objs, err := helm.ParseAsRNodes(rendered)
-			if err != nil {
-				return err
+		}
+		_, err := c.filter.SetValues(c.obj)
+		if err != nil {
+			return err
+		}
+		results = append(results, c.filter.UnmatchedResults()...)
+		failures += c.filter.Failures()
+		if verify != nil {
+			results = append(results, c.filter.SignatureResults()...)
+			if verify.Mode == VerifyModeAnnotate {
+				if err := c.filter.AnnotateSignatures(c.obj); err != nil {
+					return err
+				}
+			} else {
+				unverified += c.filter.SignatureFailures()
 			}
-			imageFilter := NewImageFilter()
-			_, err = imageFilter.Filter(objs)
-			if err != nil {
+		}
+	}
+	if pinFilter != nil {
+		pinFilter.useLookups(i)
+		results = append(results, pinFilter.UpgradeResults()...)
+		if verify != nil && verify.Mode == VerifyModeAnnotate {
+			if err := pinFilter.AnnotateManifestSignatures(manifests); err != nil {
 				return err
 			}
-			imageFilter.LookupDigests()
-			for _, image := range imageFilter.Images {
-				results = append(results, &framework.Result{
-					Message:  fmt.Sprintf("image: %v\n", image+"@"+imageFilter.Digests[image]),
-					Severity: framework.Info,
-				})
+		}
+		pinResults, err := pinFilter.pinManifests(manifests)
+		results = append(results, pinResults...)
+		if err != nil {
+			resourceList.Results = results
+			return err
+		}
+		failures += pinFilter.Failures()
+		if verify != nil {
+			results = append(results, pinFilter.SignatureResults()...)
+			if verify.Mode == VerifyModeFail {
+				unverified += pinFilter.SignatureFailures()
 			}
-			_, err = imageFilter.SetDigests(iobj)
-			if err != nil {
+		}
+	}
+	resourceList.Results = results
+	if failures > 0 && i.failPolicy() == FailPolicyFail {
+		return fmt.Errorf("%d unresolved images or unmatched patterns", failures)
+	}
+	if unverified > 0 {
+		return fmt.Errorf("%d images without valid signature", unverified)
+	}
+	return nil
+}
+
+// loadOfflineSources loads the lock resource from items and the OCI layout from function config
+func (i *ImageFilter) loadOfflineSources(items []*yaml.RNode) error {
+	if i.Lock == nil && i.Config.LookupMode != LookupModeRefreshLock {
+		lock, err := findDigestLock(items)
+		if err != nil {
+			return err
+		}
+		if lock != nil {
+			if i.Lock, err = readDigestLock(lock); err != nil {
 				return err
 			}
 		}
 	}
-	resourceList.Results = results
+	if i.Layout == nil && i.Config.OCILayout != "" {
+		var err error
+		if i.Layout, err = newOCILayout(i.Config.OCILayout); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// lookupCluster returns a fake cluster serving the lookup objects of
+// items, such that charts using the Helm 'lookup' function render with
+// the same images as with render-helm-chart. Nil is returned if there
+// are no lookup objects
+func lookupCluster(items []*yaml.RNode) (*helm.FakeCluster, error) {
+	objs, err := kubeObjects(items, func(item *yaml.RNode) bool {
+		return item.GetAnnotations()[api.HelmResourceAnnotationLookupObject] == "true"
+	})
+	if err != nil {
+		return nil, err
+	}
+	lookupObjects, err := helm.LookupObjects(objs)
+	if err != nil || len(lookupObjects) == 0 {
+		return nil, err
+	}
+	cluster, err := helm.NewFakeCluster(lookupObjects)
+	if err != nil {
+		return nil, fmt.Errorf("creating fake cluster for lookup: %w", err)
+	}
+	return cluster, nil
+}
+
+// clusterProfile returns the ClusterProfile of items, or nil if there
+// is none, such that charts render with the same capabilities as with
+// render-helm-chart
+func clusterProfile(items []*yaml.RNode) (*t.ClusterProfile, error) {
+	objs, err := kubeObjects(items, func(item *yaml.RNode) bool {
+		return item.GetApiVersion() == api.HelmResourceAPIVersion && item.GetKind() == "ClusterProfile"
+	})
+	if err != nil {
+		return nil, err
+	}
+	return helm.ClusterProfileFromObjects(objs)
+}
+
+// kubeObjects converts the items selected by include
+func kubeObjects(items []*yaml.RNode, include func(*yaml.RNode) bool) (fn.KubeObjects, error) {
+	var objs fn.KubeObjects
+	for _, item := range items {
+		if !include(item) {
+			continue
+		}
+		o, err := fn.ParseKubeObject([]byte(item.MustString()))
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, o)
+	}
+	return objs, nil
+}
+
+// chartImages renders the charts of a RenderHelmChart resource and
+// returns a filter holding the images found. Charts are rendered
+// against cluster, if not nil, for the Helm 'lookup' function and
+// with the defaults of profile, if not nil
+func (i *ImageFilter) chartImages(iobj *yaml.RNode, cluster *helm.FakeCluster, profile *t.ClusterProfile) (*ImageFilter, error) {
+	spec, err := t.ParseKptSpec([]byte(iobj.MustString()))
+	if err != nil {
+		return nil, err
+	}
+	for idx := range spec.Charts {
+		if spec.Charts[idx].Options.ReleaseName == "" {
+			return nil, fmt.Errorf("invalid chart spec %s: ReleaseName required, index %d", iobj.GetName(), idx)
+		}
+	}
+	imageFilter, err := NewImageFilterFromConfig(i.Config)
+	if err != nil {
+		return nil, err
+	}
+	for idx := range spec.Charts {
+		if profile != nil {
+			profile.ApplyDefaults(&spec.Charts[idx].Options)
+		}
+		chartTarball, err := base64.StdEncoding.DecodeString(spec.Charts[idx].Chart)
+		if err != nil {
+			return nil, err
+		}
+		if len(chartTarball) == 0 {
+			return nil, fmt.Errorf("no embedded chart found")
+		}
+		rendered, err := helm.Template(&spec.Charts[idx], chartTarball, cluster)
+		if err != nil {
+			return nil, err
+		}
+		objs, err := helm.ParseAsRNodes(rendered)
+		if err != nil {
+			return nil, err
+		}
+		n := len(imageFilter.Images)
+		_, err = imageFilter.Filter(objs)
+		if err != nil {
+			return nil, err
+		}
+		imageFilter.charts = append(imageFilter.charts, chartImageList{
+			name:   spec.Charts[idx].Args.Name,
+			images: imageFilter.Images[n:],
+		})
+	}
+	return imageFilter, nil
+}
+
+// useLookups copies lookup results for the images of this filter from another filter
+func (i *ImageFilter) useLookups(from *ImageFilter) {
+	for _, image := range i.Images {
+		if digest, found := from.Digests[image]; found {
+			i.Digests[image] = digest
+			i.Platforms[image] = from.Platforms[image]
+		}
+		if err, found := from.Errors[image]; found {
+			i.Errors[image] = err
+		}
+		if err, found := from.Signatures[image]; found {
+			i.Signatures[image] = err
+			i.Attestations[image] = from.Attestations[image]
+		}
+		if u, found := from.Upgrades[image]; found {
+			i.Upgrades[image] = u
+			if digest, found := from.Digests[u.Upgraded]; found {
+				i.Digests[u.Upgraded] = digest
+			}
+		}
+		if err, found := from.UpgradeErrors[image]; found {
+			i.UpgradeErrors[image] = err
+		}
+	}
+}
+
 func (i *ImageFilter) Filter(nodes []*yaml.RNode) ([]*yaml.RNode, error) { //nolint:unparam // return value is unused, but we want the common filter prototype
 	for idx := range nodes {
+		i.setObject(nodes[idx])
 		err := Walk(i, nodes[idx], "")
 		if err != nil {
 			return nil, err
@@ -120,31 +501,335 @@ func (i *ImageFilter) Filter(nodes []*yaml.RNode) ([]*yaml.RNode, error) { //nol
 	return nodes, nil
 }
 
-func (i *ImageFilter) VisitScalar(node *yaml.RNode, path string) error {
+// setObject sets the group and kind of the object about to be walked
+func (i *ImageFilter) setObject(node *yaml.RNode) {
+	i.kind = node.GetKind()
+	i.group, _, _ = strings.Cut(node.GetApiVersion(), "/")
+	if !strings.Contains(node.GetApiVersion(), "/") {
+		i.group = "" // Core group
+	}
+}
+
+// isImagePath returns true if path identifies an image field of the object currently being walked
+func (i *ImageFilter) isImagePath(path string) bool {
 	for idx := range i.PathFilters {
-		if i.PathFilters[idx].MatchString(path) {
-			i.Images = append(i.Images, yaml.GetValue(node))
-			break
+		f := &i.PathFilters[idx]
+		if f.Path.MatchString(path) && i.matchKind(f) {
+			return true
 		}
 	}
+	return false
+}
+
+// matchKind returns true if the filter applies to the object currently being walked
+func (i *ImageFilter) matchKind(f *PathFilter) bool {
+	if len(f.Kinds) == 0 {
+		return true
+	}
+	for _, k := range f.Kinds {
+		group, kind, found := strings.Cut(k, "/")
+		if !found {
+			kind = group
+			if kind == i.kind {
+				return true
+			}
+		} else if group == i.group && kind == i.kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *ImageFilter) VisitScalar(node *yaml.RNode, path string) error {
+	if i.isImagePath(path) {
+		i.Images = append(i.Images, yaml.GetValue(node))
+	}
+	return nil
+}
+
+// VisitMapping identifies images split into repository and tag fields
+func (i *ImageFilter) VisitMapping(node *yaml.RNode, path string) error {
+	if image, _ := i.repoTagImage(node, path); image != "" {
+		i.Images = append(i.Images, image)
+	}
 	return nil
 }
 
+// repoTagImage returns the image of a mapping with split repository
+// and tag fields together with the filter identifying it. An empty
+// image is returned if no filter matches
+func (i *ImageFilter) repoTagImage(node *yaml.RNode, path string) (string, *RepoTagFilter) {
+	for idx := range i.RepoTagFilters {
+		f := &i.RepoTagFilters[idx]
+		if !f.Path.MatchString(path) || !i.matchKind(&f.PathFilter) {
+			continue
+		}
+		repo := fieldValue(node, f.Repository)
+		tag := fieldValue(node, f.Tag)
+		if repo == "" || tag == "" {
+			continue
+		}
+		if registry := fieldValue(node, f.Registry); registry != "" {
+			repo = registry + "/" + repo
+		}
+		if strings.HasPrefix(tag, "sha256:") {
+			return repo + "@" + tag, f
+		}
+		return repo + ":" + tag, f
+	}
+	return "", nil
+}
+
+// fieldValue returns the value of a scalar field or an empty string
+func fieldValue(node *yaml.RNode, field string) string {
+	if field == "" {
+		return ""
+	}
+	f := node.Field(field)
+	if f == nil || f.Value.YNode().Kind != yaml.ScalarNode {
+		return ""
+	}
+	return yaml.GetValue(f.Value)
+}
+
+// LookupDigests looks up digests of unique images in the lock, OCI
+// layout and registries. Registry lookups are made concurrently
 func (i *ImageFilter) LookupDigests() {
+	var platform *v1.Platform
+	offline := false
+	if i.Config != nil {
+		if i.Config.Platform != "" {
+			// Validated with function config
+			platform, _ = v1.ParsePlatform(i.Config.Platform)
+		}
+		offline = i.Config.LookupMode == LookupModeOffline
+	}
+
+	var remoteImages []string
+	seen := map[string]bool{}
 	for _, image := range i.Images {
-		if strings.Contains(image, "@") {
+		if strings.Contains(image, "@") || seen[image] {
+			continue
+		}
+		seen[image] = true
+		if _, found := i.Digests[image]; found {
 			continue
 		}
-		digest, err := crane.Digest(image, crane.WithUserAgent(fmt.Sprintf("digester/%s", version.Version)))
-		// We dont fail here if we cannot locate a digest, only if the digest is needed for a patch-back target
-		if err == nil {
+		if digest, found := i.Lock[image]; found {
 			i.Digests[image] = digest
+			continue
+		}
+		if i.Layout != nil {
+			digest, platforms, found, err := i.Layout.Lookup(image, platform)
+			if found {
+				if err != nil {
+					i.Errors[image] = err
+				} else {
+					i.Digests[image] = digest
+					i.Platforms[image] = platforms
+				}
+				continue
+			}
+		}
+		if offline {
+			i.Errors[image] = fmt.Errorf("not found in lock or OCI layout and lookup mode is offline")
+			continue
+		}
+		remoteImages = append(remoteImages, image)
+	}
+
+	opts := i.remoteOptions()
+	i.forEachImage(remoteImages, func(image string) {
+		digest, platforms, err := lookupDigest(image, platform, opts...)
+		i.mu.Lock()
+		defer i.mu.Unlock()
+		// Errors are handled according to the fail policy when reporting
+		if err != nil {
+			i.Errors[image] = err
+			return
+		}
+		i.Digests[image] = digest
+		i.Platforms[image] = platforms
+	})
+}
+
+// remoteOptions returns options for registry lookups
+func (i *ImageFilter) remoteOptions() []remote.Option {
+	opts := []remote.Option{
+		remote.WithUserAgent(fmt.Sprintf("digester/%s", version.Version)),
+		remote.WithRetryStatusCodes(retryStatusCodes...),
+	}
+	if i.Config != nil && i.Config.Retries != nil {
+		backoff := remote.Backoff{
+			Duration: time.Second,
+			Factor:   2.0,
+			Jitter:   0.1,
+			Steps:    *i.Config.Retries + 1,
+		}
+		// Status codes are retried by our own transport, since the
+		// transport added by remote always uses its default backoff
+		opts = append(opts,
+			remote.WithTransport(transport.NewRetry(remote.DefaultTransport,
+				transport.WithRetryBackoff(backoff),
+				transport.WithRetryStatusCodes(retryStatusCodes...))),
+			remote.WithRetryStatusCodes(),
+			remote.WithRetryBackoff(backoff))
+	}
+	if i.Keychain != nil {
+		opts = append(opts, remote.WithAuthFromKeychain(i.Keychain))
+	}
+	return opts
+}
+
+// lookupDigest returns the digest of an image together with the
+// platforms available. If platform is nil, the digest returned is that
+// of the image index (or image manifest for single-platform images),
+// otherwise the digest of the manifest for the given platform
+func lookupDigest(image string, platform *v1.Platform, opts ...remote.Option) (string, []string, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return "", nil, err
+	}
+	desc, err := remote.Get(ref, opts...)
+	if err != nil {
+		return "", nil, err
+	}
+	return resolveDigest(image, &desc.Descriptor, desc.ImageIndex, platform)
+}
+
+// resolveDigest returns the digest of an image described by desc,
+// optionally for a specific platform. The index function returns the
+// image index if desc describes an index
+func resolveDigest(image string, desc *v1.Descriptor, index func() (v1.ImageIndex, error), platform *v1.Platform) (string, []string, error) {
+	if !desc.MediaType.IsIndex() {
+		var platforms []string
+		if desc.Platform != nil {
+			platforms = []string{desc.Platform.String()}
+		}
+		return desc.Digest.String(), platforms, nil
+	}
+	idx, err := index()
+	if err != nil {
+		return "", nil, err
+	}
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return "", nil, err
+	}
+	var platforms []string
+	var match string
+	for idx := range manifest.Manifests {
+		m := &manifest.Manifests[idx]
+		if m.Platform == nil || m.Platform.OS == "unknown" { // e.g. attestation manifests
+			continue
 		}
+		platforms = append(platforms, m.Platform.String())
+		if platform != nil && match == "" && m.Platform.Satisfies(*platform) {
+			match = m.Digest.String()
+		}
+	}
+	if platform == nil {
+		return desc.Digest.String(), platforms, nil
+	}
+	if match == "" {
+		return "", platforms, fmt.Errorf("platform %v not found for image %v", platform, image)
+	}
+	return match, platforms, nil
+}
+
+// platformsInfo returns a description of the platforms available for an image
+func (i *ImageFilter) platformsInfo(image string) string {
+	platforms := i.Platforms[image]
+	if len(platforms) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (platforms: %v)", strings.Join(platforms, ", "))
+}
+
+// failPolicy returns the policy for unresolved images and unmatched patterns
+func (i *ImageFilter) failPolicy() string {
+	if i.Config == nil || i.Config.FailPolicy == "" {
+		return FailPolicyWarn
 	}
+	return i.Config.FailPolicy
+}
+
+// failureSeverity returns the result severity of unresolved images and unmatched patterns
+func (i *ImageFilter) failureSeverity() framework.Severity {
+	switch i.failPolicy() {
+	case FailPolicyFail:
+		return framework.Error
+	case FailPolicyKeepExisting:
+		return framework.Info
+	}
+	return framework.Warning
+}
+
+// ImageResults returns a result per unique image with its resolution status
+func (i *ImageFilter) ImageResults() []*framework.Result {
+	var results []*framework.Result
+	seen := map[string]bool{}
+	for _, image := range i.Images {
+		if seen[image] {
+			continue
+		}
+		seen[image] = true
+		switch {
+		case strings.Contains(image, "@"):
+			results = append(results, &framework.Result{
+				Message:  fmt.Sprintf("image: %v: already pinned\n", image),
+				Severity: framework.Info,
+			})
+		case i.Digests[image] != "":
+			results = append(results, &framework.Result{
+				Message:  fmt.Sprintf("image: %v: resolved%v\n", image+"@"+i.Digests[image], i.platformsInfo(image)),
+				Severity: framework.Info,
+			})
+		default:
+			results = append(results, &framework.Result{
+				Message:  fmt.Sprintf("image: %v: unresolved: %v\n", image, i.Errors[image]),
+				Severity: i.failureSeverity(),
+			})
+		}
+	}
+	return results
+}
+
+// UnmatchedResults returns a result per '# digester:' pattern not
+// matching any image, or matching an unresolved image with the existing
+// value cleared
+func (i *ImageFilter) UnmatchedResults() []*framework.Result {
+	var results []*framework.Result
+	for _, re := range i.Unmatched {
+		results = append(results, &framework.Result{
+			Message:  fmt.Sprintf("pattern %q matches no image, keeping existing value\n", re),
+			Severity: i.failureSeverity(),
+		})
+	}
+	for _, re := range i.Cleared {
+		results = append(results, &framework.Result{
+			Message:  fmt.Sprintf("pattern %q matches an unresolved image, clearing existing value\n", re),
+			Severity: i.failureSeverity(),
+		})
+	}
+	return results
+}
+
+// Failures returns the number of unresolved images and unmatched patterns
+func (i *ImageFilter) Failures() int {
+	return len(i.Errors) + len(i.Unmatched)
 }
 
 type ImageDigestSetter struct {
 	Digests map[string]string
+	// Images without digest
+	Unresolved []string
+	// Keep existing digests of unresolved images instead of clearing them
+	KeepExisting bool
+	// Patterns not matching any image
+	Unmatched []string
+	// Patterns matching an unresolved image, for which the existing digest was cleared
+	Cleared []string
 }
 
 func (i *ImageDigestSetter) VisitScalar(node *yaml.RNode, _ string) error {
@@ -165,16 +850,48 @@ func (i *ImageDigestSetter) VisitScalar(node *yaml.RNode, _ string) error {
 				// We dont break such that we can check for unique match
 			}
 		}
+		if match == "" {
+			if slices.ContainsFunc(i.Unresolved, pattern.MatchString) {
+				// The existing digest is stale unless kept explicitly
+				if !i.KeepExisting && node.YNode().Value != "" {
+					node.YNode().Value = ""
+					i.Cleared = append(i.Cleared, re)
+				}
+				return nil
+			}
+			// Never blank out an existing digest
+			i.Unmatched = append(i.Unmatched, re)
+			return nil
+		}
 		node.YNode().Value = match
 	}
 	return nil
 }
 
+// effectiveDigests returns the digests of images as deployed, i.e.
+// without images replaced by an upgrade, such that comment markers
+// matching both the current and upgraded image resolve to the latter
+func (i *ImageFilter) effectiveDigests() map[string]string {
+	digests := make(map[string]string, len(i.Digests))
+	for image, digest := range i.Digests {
+		if _, upgraded := i.upgraded(image); !upgraded {
+			digests[image] = digest
+		}
+	}
+	return digests
+}
+
 func (i *ImageFilter) SetDigests(node *yaml.RNode) (*yaml.RNode, error) { //nolint:unparam // return value is unused, but we want the common filter prototype
-	setter := &ImageDigestSetter{Digests: i.Digests}
+	setter := &ImageDigestSetter{
+		Digests:      i.effectiveDigests(),
+		Unresolved:   slices.Sorted(maps.Keys(i.Errors)),
+		KeepExisting: i.failPolicy() == FailPolicyKeepExisting,
+	}
 	err := Walk(setter, node, "")
 	if err != nil {
 		return nil, err
 	}
+	i.Unmatched = append(i.Unmatched, setter.Unmatched...)
+	i.Cleared = append(i.Cleared, setter.Cleared...)
 	return node, nil
 }
@@ -1,10 +1,27 @@
 package main
 
 import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/krm-functions/catalog/pkg/helm"
+	"github.com/krm-functions/catalog/pkg/helmspecs"
 	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/kustomize/kyaml/fn/framework"
 	"sigs.k8s.io/kustomize/kyaml/yaml"
 )
 
@@ -201,6 +218,81 @@ spec:
 	assert.Equal(t, "busybox:1.31", imageFilter.Images[9])
 }
 
+func TestLookupImagesExtended(t *testing.T) {
+	input := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: debug
+spec:
+  ephemeralContainers:
+  - name: debugger
+    image: busybox:1.32
+---
+apiVersion: tekton.dev/v1
+kind: Task
+metadata:
+  name: build
+spec:
+  steps:
+  - name: build
+    image: golang:1.23
+  sidecars:
+  - name: docker
+    image: docker:dind
+---
+apiVersion: monitoring.coreos.com/v1
+kind: Prometheus
+metadata:
+  name: prometheus
+spec:
+  image: quay.io/prometheus/prometheus:v2.53.0
+---
+apiVersion: example.com/v1
+kind: Database
+metadata:
+  name: db
+spec:
+  image:
+    repository: example.com/postgres
+    tag: "16.3"
+  exporter:
+    registry: ghcr.io
+    repo: example/exporter
+    version: v1.0.0
+---
+apiVersion: example.com/v1
+kind: Other
+metadata:
+  name: other
+spec:
+  image: not-an-image-since-kind-is-unknown
+`
+	objs, err := helm.ParseAsRNodes([]byte(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &FunctionConfig{
+		ImageRepoTagPaths: []ImageRepoTagPath{{Path: `^\.spec\.exporter$`, Kinds: []string{"Database"}, Registry: "registry", Repository: "repo", Tag: "version"}},
+	}
+	imageFilter, err := NewImageFilterFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = imageFilter.Filter(objs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{
+		"busybox:1.32",
+		"golang:1.23",
+		"docker:dind",
+		"quay.io/prometheus/prometheus:v2.53.0",
+		"example.com/postgres:16.3",
+		"ghcr.io/example/exporter:v1.0.0",
+	}, imageFilter.Images)
+}
+
 func TestSetDigests(t *testing.T) {
 	input := `
 apiVersion: fn.kpt.dev/v1alpha1
@@ -267,3 +359,488 @@ func assertDigest(t *testing.T, node *yaml.RNode, want string, path ...string) {
 	}
 	assert.Equal(t, want, yaml.GetValue(found))
 }
+
+func TestPinImages(t *testing.T) {
+	input := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      initContainers:
+      - name: init
+        image: busybox:1.36
+      containers:
+      - name: app
+        image: example.com/app:1.0.0
+      - name: sidecar
+        image: example.com/sidecar:2.0.0@sha256:aaa
+---
+apiVersion: example.com/v1
+kind: Database
+metadata:
+  name: db
+spec:
+  image:
+    repository: example.com/postgres
+    tag: "16.3"
+`
+	objs, err := helm.ParseAsRNodes([]byte(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageFilter := NewImageFilter()
+	_, err = imageFilter.Filter(objs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := selectImages(imageFilter.Images, nil, []string{`^busybox:`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"example.com/app:1.0.0", "example.com/sidecar:2.0.0@sha256:aaa", "example.com/postgres:16.3"}, images)
+
+	imageFilter.Digests["example.com/app:1.0.0"] = "sha256:bbb"
+	imageFilter.Digests["example.com/postgres:16.3"] = "sha256:ccc"
+	pinner := &ImagePinner{filter: imageFilter, pin: true}
+	for _, obj := range objs {
+		imageFilter.setObject(obj)
+		if err = Walk(pinner, obj, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.Equal(t, 2, pinner.Pinned)
+	assertDigest(t, objs[1], "16.3@sha256:ccc", "spec", "image", "tag")
+	assertDigest(t, objs[1], "example.com/postgres", "spec", "image", "repository")
+	assertDigest(t, objs[0], "example.com/app:1.0.0@sha256:bbb", "spec", "template", "spec", "containers", "[name=app]", "image")
+	assertDigest(t, objs[0], "example.com/sidecar:2.0.0@sha256:aaa", "spec", "template", "spec", "containers", "[name=sidecar]", "image")
+	assertDigest(t, objs[0], "busybox:1.36", "spec", "template", "spec", "initContainers", "[name=init]", "image")
+}
+
+func TestLookupDigestPlatform(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	var idx v1.ImageIndex = empty.Index
+	for _, p := range []string{"linux/amd64", "linux/arm64"} {
+		img, err := random.Image(64, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		platform, _ := v1.ParsePlatform(p)
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: platform},
+		})
+	}
+	image := host + "/app:1.0.0"
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = remote.WriteIndex(ref, idx); err != nil {
+		t.Fatal(err)
+	}
+	idxDigest, _ := idx.Digest()
+	manifest, _ := idx.IndexManifest()
+
+	digest, platforms, err := lookupDigest(image, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, idxDigest.String(), digest)
+	assert.Equal(t, []string{"linux/amd64", "linux/arm64"}, platforms)
+
+	arm64, _ := v1.ParsePlatform("linux/arm64")
+	digest, _, err = lookupDigest(image, arm64)
+	assert.NoError(t, err)
+	assert.Equal(t, manifest.Manifests[1].Digest.String(), digest)
+
+	s390x, _ := v1.ParsePlatform("linux/s390x")
+	_, _, err = lookupDigest(image, s390x)
+	assert.Error(t, err)
+}
+
+func TestFailPolicy(t *testing.T) {
+	input := `apiVersion: experimental.helm.sh/v1alpha1
+kind: RenderHelmChart
+metadata:
+  name: app
+helmCharts:
+- templateOptions:
+    values:
+      valuesInline:
+        image:
+          digest: sha256:old # digester: example.com/app:.*
+        sidecar:
+          digest: "" # digester: example.com/sidecar:.*
+`
+	objs, err := helm.ParseAsRNodes([]byte(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageFilter, err := NewImageFilterFromConfig(&FunctionConfig{FailPolicy: FailPolicyFail})
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageFilter.Images = []string{"example.com/sidecar:1.0", "example.com/other:1.0"}
+	imageFilter.Digests["example.com/sidecar:1.0"] = "sha256:abc"
+	imageFilter.Errors["example.com/other:1.0"] = fmt.Errorf("not found")
+	_, err = imageFilter.SetDigests(objs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Existing digest is not blanked out
+	assertDigest(t, objs[0], "sha256:old",
+		"helmCharts", "0", "templateOptions", "values", "valuesInline", "image", "digest")
+	assertDigest(t, objs[0], "sha256:abc",
+		"helmCharts", "0", "templateOptions", "values", "valuesInline", "sidecar", "digest")
+	assert.Equal(t, []string{"example.com/app:.*"}, imageFilter.Unmatched)
+	assert.Equal(t, 2, imageFilter.Failures())
+
+	results := imageFilter.ImageResults()
+	assert.Equal(t, 2, len(results))
+	assert.Equal(t, framework.Info, results[0].Severity)
+	assert.Equal(t, framework.Error, results[1].Severity)
+	assert.Contains(t, results[1].Message, "example.com/other:1.0: unresolved: not found")
+
+	imageFilter.Config.FailPolicy = FailPolicyKeepExisting
+	assert.Equal(t, framework.Info, imageFilter.UnmatchedResults()[0].Severity)
+}
+
+func TestFailPolicyUnresolvedDigests(t *testing.T) {
+	input := `apiVersion: experimental.helm.sh/v1alpha1
+kind: RenderHelmChart
+metadata:
+  name: app
+helmCharts:
+- templateOptions:
+    values:
+      valuesInline:
+        image:
+          digest: sha256:old # digester: example.com/app:.*
+        sidecar:
+          tag: "1.0"
+          digest: sha256:old
+`
+	for _, tc := range []struct {
+		policy string
+		digest string
+	}{
+		{FailPolicyWarn, ""},
+		{FailPolicyKeepExisting, "sha256:old"},
+	} {
+		objs, err := helm.ParseAsRNodes([]byte(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		imageFilter, err := NewImageFilterFromConfig(&FunctionConfig{
+			FailPolicy:  tc.policy,
+			ImageValues: []ImageValues{{Image: "example.com/sidecar:.*", Tag: "sidecar.tag", Digest: "sidecar.digest"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		imageFilter.Images = []string{"example.com/app:2.0", "example.com/sidecar:2.0"}
+		imageFilter.Errors["example.com/app:2.0"] = fmt.Errorf("not found")
+		imageFilter.Errors["example.com/sidecar:2.0"] = fmt.Errorf("not found")
+		imageFilter.charts = []chartImageList{{name: "app", images: imageFilter.Images}}
+		if _, err = imageFilter.SetDigests(objs[0]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = imageFilter.SetValues(objs[0]); err != nil {
+			t.Fatal(err)
+		}
+		// Unresolved images keep the existing digest only with 'keep-existing'
+		assertDigest(t, objs[0], tc.digest,
+			"helmCharts", "0", "templateOptions", "values", "valuesInline", "image", "digest")
+		assertDigest(t, objs[0], tc.digest,
+			"helmCharts", "0", "templateOptions", "values", "valuesInline", "sidecar", "digest")
+		assertDigest(t, objs[0], "2.0",
+			"helmCharts", "0", "templateOptions", "values", "valuesInline", "sidecar", "tag")
+		assert.Empty(t, imageFilter.Unmatched, tc.policy)
+		assert.Equal(t, 2, imageFilter.Failures(), tc.policy)
+		if tc.digest == "" {
+			results := imageFilter.UnmatchedResults()
+			assert.Equal(t, 2, len(results))
+			assert.Equal(t, framework.Warning, results[0].Severity)
+			assert.Contains(t, results[0].Message, "matches an unresolved image, clearing existing value")
+			assert.Contains(t, objs[0].MustString(), `digest: "" # digester: example.com/app:.*`)
+		} else {
+			assert.Empty(t, imageFilter.UnmatchedResults(), tc.policy)
+		}
+	}
+}
+
+func TestLookupDigestsConcurrent(t *testing.T) {
+	reg := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	var mu sync.Mutex
+	manifestGets := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/manifests/") {
+			mu.Lock()
+			manifestGets[r.URL.Path]++
+			n := manifestGets[r.URL.Path]
+			mu.Unlock()
+			if strings.Contains(r.URL.Path, "/throttled/") && n == 1 {
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	var images []string
+	for _, repo := range []string{"app", "sidecar", "throttled"} {
+		img, err := random.Image(64, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		image := host + "/" + repo + ":1.0.0"
+		ref, _ := name.ParseReference(image)
+		if err = remote.Write(ref, img); err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, image, image)
+	}
+	mu.Lock()
+	clear(manifestGets)
+	mu.Unlock()
+
+	cfg := &FunctionConfig{}
+	_ = cfg.Default()
+	imageFilter, _ := NewImageFilterFromConfig(cfg)
+	imageFilter.Images = images
+	imageFilter.LookupDigests()
+
+	assert.Equal(t, 3, len(imageFilter.Digests))
+	assert.Equal(t, 0, len(imageFilter.Errors))
+	assert.Equal(t, 1, manifestGets["/v2/app/manifests/1.0.0"])
+	assert.Equal(t, 1, manifestGets["/v2/sidecar/manifests/1.0.0"])
+	assert.Equal(t, 2, manifestGets["/v2/throttled/manifests/1.0.0"])
+
+	// Retries can be disabled
+	mu.Lock()
+	clear(manifestGets)
+	mu.Unlock()
+	noRetries := 0
+	cfg = &FunctionConfig{Retries: &noRetries}
+	_ = cfg.Default()
+	imageFilter, _ = NewImageFilterFromConfig(cfg)
+	imageFilter.Images = images
+	imageFilter.LookupDigests()
+	assert.Equal(t, 1, len(imageFilter.Errors))
+	assert.Equal(t, 1, manifestGets["/v2/throttled/manifests/1.0.0"])
+}
+
+func TestRegistryLimiter(t *testing.T) {
+	l := newRegistryLimiter(20)
+	start := time.Now()
+	for range 3 {
+		l.Wait("example.com")
+	}
+	l.Wait("other.example.com")
+	// Two intervals of 50ms for 'example.com', while 'other.example.com' is not delayed
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestSetValues(t *testing.T) {
+	input := `apiVersion: experimental.helm.sh/v1alpha1
+kind: RenderHelmChart
+metadata:
+  name: charts
+helmCharts:
+- chartArgs:
+    name: cert-manager
+  templateOptions:
+    values:
+      valuesInline:
+        image:
+          tag: v1.0.0
+- chartArgs:
+    name: other
+  templateOptions:
+    releaseName: other
+`
+	objs, err := helm.ParseAsRNodes([]byte(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &FunctionConfig{ImageValues: []ImageValues{
+		{Image: `/cert-manager-controller:`, Chart: "cert-manager", Digest: "image.digest", Tag: "image.tag", Repository: "image.repository"},
+		{Image: `/other:`, Digest: "other.image.digest"},
+		{Image: `/missing:`, Digest: "missing.digest"},
+	}}
+	_ = cfg.Default()
+	imageFilter, _ := NewImageFilterFromConfig(cfg)
+	imageFilter.charts = []chartImageList{
+		{name: "cert-manager", images: []string{"quay.io/jetstack/cert-manager-controller:v1.2.3", "quay.io/jetstack/cert-manager-controller:v1.2.3"}},
+		{name: "other", images: []string{"localhost:5000/other:2.0@sha256:bcd"}},
+	}
+	imageFilter.Digests["quay.io/jetstack/cert-manager-controller:v1.2.3"] = "sha256:abc"
+	_, err = imageFilter.SetValues(objs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	valuesPath := []string{"helmCharts", "0", "templateOptions", "values", "valuesInline", "image"}
+	assertDigest(t, objs[0], "sha256:abc", append(valuesPath, "digest")...)
+	assertDigest(t, objs[0], "v1.2.3", append(valuesPath, "tag")...)
+	assertDigest(t, objs[0], "quay.io/jetstack/cert-manager-controller", append(valuesPath, "repository")...)
+	image, _ := objs[0].Pipe(yaml.Lookup(valuesPath...))
+	fields, _ := image.Fields()
+	assert.Equal(t, []string{"tag", "repository", "digest"}, fields) // New values are added in a fixed order
+	assertDigest(t, objs[0], "sha256:bcd", "helmCharts", "1", "templateOptions", "values", "valuesInline", "other", "image", "digest")
+	assert.Equal(t, []string{"/missing:"}, imageFilter.Unmatched)
+
+	assert.Equal(t, imageParts{"localhost:5000/app", "", ""}, splitImage("localhost:5000/app"))
+}
+
+func TestLookupUpgrades(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	digests := map[string]string{}
+	for _, tag := range []string{"1.4.0", "1.4.2", "1.5.0", "latest"} {
+		img, err := random.Image(64, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, _ := name.ParseReference(host + "/app:" + tag)
+		if err = remote.Write(ref, img); err != nil {
+			t.Fatal(err)
+		}
+		d, _ := img.Digest()
+		digests[tag] = d.String()
+	}
+
+	cfg := &FunctionConfig{ImageUpgrades: []ImageUpgrade{{Image: "/app:", Constraint: "~1.4"}}}
+	_ = cfg.Default()
+	imageFilter, _ := NewImageFilterFromConfig(cfg)
+	imageFilter.Images = []string{host + "/app:1.4.0"}
+	if err := imageFilter.LookupUpgrades(); err != nil {
+		t.Fatal(err)
+	}
+	imageFilter.LookupDigests()
+	assert.Equal(t, UpgradeInfo{
+		Current:    host + "/app:1.4.0",
+		Upgraded:   host + "/app:1.4.2",
+		Distance:   "0.0.2",
+		Constraint: "~1.4",
+	}, imageFilter.Upgrades[imageFilter.Images[0]])
+	assert.Equal(t, digests["1.4.2"], imageFilter.Digests[host+"/app:1.4.2"])
+
+	objs, err := helm.ParseAsRNodes([]byte(fmt.Sprintf(`apiVersion: v1
+kind: Pod
+metadata:
+  name: app
+spec:
+  containers:
+  - name: app
+    image: %s
+`, imageFilter.Images[0])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := imageFilter.pinManifests(objs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertDigest(t, objs[0], host+"/app:1.4.2@"+digests["1.4.2"], "spec", "containers", "[name=app]", "image")
+	assert.Contains(t, results[len(results)-1].Message, "pinned 1 and upgraded 1 image fields")
+	assert.Contains(t, imageFilter.UpgradeResults()[0].Message, `"semverDistance":"0.0.2","constraint":"~1.4"`)
+
+	// Comment markers and values of charts resolve to the upgraded image
+	chart, err := yaml.Parse(`apiVersion: fn.kpt.dev/v1alpha1
+kind: RenderHelmChart
+metadata:
+  name: app
+helmCharts:
+- chartArgs:
+    name: app
+  templateOptions:
+    values:
+      valuesInline:
+        image:
+          digest: "" # digester: .*/app:.*
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chartCfg := &FunctionConfig{
+		ImageUpgrades: cfg.ImageUpgrades,
+		ImageValues:   []ImageValues{{Image: "/app:", Tag: "image.tag"}},
+	}
+	_ = chartCfg.Default()
+	chartFilter, _ := NewImageFilterFromConfig(chartCfg)
+	chartFilter.Images = imageFilter.Images[:1]
+	chartFilter.charts = []chartImageList{{name: "app", images: chartFilter.Images}}
+	chartFilter.useLookups(imageFilter)
+	if _, err = chartFilter.SetDigests(chart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = chartFilter.SetValues(chart); err != nil {
+		t.Fatal(err)
+	}
+	valuesPath := []string{"helmCharts", "0", "templateOptions", "values", "valuesInline", "image"}
+	assertDigest(t, chart, digests["1.4.2"], append(valuesPath, "digest")...)
+	assertDigest(t, chart, "1.4.2", append(valuesPath, "tag")...)
+	assert.Empty(t, chartFilter.Unmatched)
+}
+
+func TestLookupCluster(t *testing.T) {
+	objs, err := helm.ParseAsRNodes([]byte(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: image-config
+  namespace: apps
+  annotations:
+    experimental.helm.sh/lookup-object: "true"
+    config.kubernetes.io/local-config: "true"
+data:
+  tag: "1.2.3"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster, err := lookupCluster(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, cluster)
+	cluster, err = lookupCluster(objs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+	assert.FileExists(t, cluster.Kubeconfig())
+}
+
+func TestClusterProfile(t *testing.T) {
+	objs, err := helm.ParseAsRNodes([]byte(`apiVersion: experimental.helm.sh/v1alpha1
+kind: ClusterProfile
+metadata:
+  name: cluster-profile
+  annotations:
+    config.kubernetes.io/local-config: "true"
+spec:
+  kubeVersion: 1.30.0
+  apiVersions:
+  - monitoring.coreos.com/v1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, err := clusterProfile(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, profile)
+	profile, err = clusterProfile(objs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &helmspecs.HelmTemplateOptions{APIVersions: []string{"v1"}}
+	profile.ApplyDefaults(opts)
+	assert.Equal(t, "1.30.0", opts.KubeVersion)
+	assert.Equal(t, []string{"v1", "monitoring.coreos.com/v1"}, opts.APIVersions)
+}
@@ -0,0 +1,83 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// forEachImage calls f concurrently for each image, limited by the
+// concurrency and per-registry rate limit of the function config
+func (i *ImageFilter) forEachImage(images []string, f func(image string)) {
+	concurrency, rateLimit := 1, 0
+	if i.Config != nil {
+		concurrency = max(i.Config.Concurrency, 1)
+		rateLimit = i.Config.RateLimit
+	}
+	limiter := newRegistryLimiter(rateLimit)
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for _, image := range images {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(image string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if ref, err := name.ParseReference(image); err == nil {
+				limiter.Wait(ref.Context().RegistryStr())
+			}
+			f(image)
+		}(image)
+	}
+	wg.Wait()
+}
+
+// registryLimiter limits the rate of lookups per registry host
+type registryLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     map[string]time.Time
+}
+
+// newRegistryLimiter returns a limiter allowing perSecond lookups per
+// second per registry. No limit is applied if perSecond is less than one
+func newRegistryLimiter(perSecond int) *registryLimiter {
+	l := &registryLimiter{next: make(map[string]time.Time)}
+	if perSecond > 0 {
+		l.interval = time.Second / time.Duration(perSecond)
+	}
+	return l
+}
+
+// Wait blocks until a lookup towards the registry host is allowed
+func (l *registryLimiter) Wait(host string) {
+	if l.interval == 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	slot := l.next[host]
+	if slot.Before(now) {
+		slot = now
+	}
+	l.next[host] = slot.Add(l.interval)
+	l.mu.Unlock()
+	time.Sleep(time.Until(slot))
+}
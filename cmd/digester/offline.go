@@ -0,0 +1,166 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"sigs.k8s.io/kustomize/kyaml/kio/filters"
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	DigestLockAPIVersion = "fn.kpt.dev/v1alpha1"
+	DigestLockKind       = "DigestLock"
+	// Name and path of lock resources created when refreshing locks
+	digestLockName = "digests"
+	digestLockPath = "digests.lock.yaml"
+
+	// Annotations holding image references in OCI image layouts
+	ociRefNameAnnotation          = "org.opencontainers.image.ref.name"
+	containerdImageNameAnnotation = "io.containerd.image.name"
+)
+
+// DigestLock maps images to digests. Digests are looked up in the
+// lock before any other source
+type DigestLock struct {
+	// Map from image (key) to digest (value)
+	Digests map[string]string `json:"digests,omitempty" yaml:"digests,omitempty"`
+}
+
+// findDigestLock returns the lock resource from items or nil if not found
+func findDigestLock(items []*yaml.RNode) (*yaml.RNode, error) {
+	var lock *yaml.RNode
+	for _, item := range items {
+		if item.GetApiVersion() != DigestLockAPIVersion || item.GetKind() != DigestLockKind {
+			continue
+		}
+		if lock != nil {
+			return nil, fmt.Errorf("multiple %v resources found", DigestLockKind)
+		}
+		lock = item
+	}
+	return lock, nil
+}
+
+// readDigestLock returns the digests of a lock resource
+func readDigestLock(lock *yaml.RNode) (map[string]string, error) {
+	l := DigestLock{}
+	if err := yaml.Unmarshal([]byte(lock.MustString()), &l); err != nil {
+		return nil, fmt.Errorf("parsing %v %v: %w", DigestLockKind, lock.GetName(), err)
+	}
+	if l.Digests == nil {
+		l.Digests = map[string]string{}
+	}
+	return l.Digests, nil
+}
+
+// writeDigestLock writes digests to the lock resource in items. A lock
+// resource is created if none exist
+func writeDigestLock(items []*yaml.RNode, digests map[string]string) ([]*yaml.RNode, error) {
+	lock, err := findDigestLock(items)
+	if err != nil {
+		return nil, err
+	}
+	if lock == nil {
+		lock, err = yaml.Parse(fmt.Sprintf("apiVersion: %s\nkind: %s\nmetadata:\n  name: %s\n", DigestLockAPIVersion, DigestLockKind, digestLockName))
+		if err != nil {
+			return nil, err
+		}
+		err = lock.SetAnnotations(map[string]string{
+			filters.LocalConfigAnnotation: "true",
+			kioutil.PathAnnotation:        digestLockPath,
+		})
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, lock)
+	}
+	images := make([]string, 0, len(digests))
+	for image := range digests {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+	m := yaml.NewMapRNode(nil)
+	for _, image := range images {
+		if err := m.PipeE(yaml.SetField(image, yaml.NewStringRNode(digests[image]))); err != nil {
+			return nil, err
+		}
+	}
+	if err := lock.PipeE(yaml.SetField("digests", m)); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// ociLayout resolves digests from an OCI image layout directory.
+// Images are identified by the annotations
+// 'org.opencontainers.image.ref.name' or 'io.containerd.image.name'
+// holding full image references
+type ociLayout struct {
+	path        layout.Path
+	descriptors map[string]v1.Descriptor
+}
+
+func newOCILayout(dir string) (*ociLayout, error) {
+	p, err := layout.FromPath(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading OCI layout %v: %w", dir, err)
+	}
+	idx, err := p.ImageIndex()
+	if err != nil {
+		return nil, fmt.Errorf("reading OCI layout %v: %w", dir, err)
+	}
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("reading OCI layout %v: %w", dir, err)
+	}
+	l := &ociLayout{path: p, descriptors: map[string]v1.Descriptor{}}
+	for _, desc := range manifest.Manifests {
+		for _, key := range []string{containerdImageNameAnnotation, ociRefNameAnnotation} {
+			// References not parsing as full image references, e.g. plain tags, are ignored
+			if ref, err := name.ParseReference(desc.Annotations[key]); err == nil {
+				l.descriptors[ref.Name()] = desc
+			}
+		}
+	}
+	return l, nil
+}
+
+// Lookup returns the digest of an image and whether the image was found
+func (l *ociLayout) Lookup(image string, platform *v1.Platform) (digest string, platforms []string, found bool, err error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return "", nil, false, err
+	}
+	desc, found := l.descriptors[ref.Name()]
+	if !found {
+		return "", nil, false, nil
+	}
+	index := func() (v1.ImageIndex, error) {
+		root, err := l.path.ImageIndex()
+		if err != nil {
+			return nil, err
+		}
+		return root.ImageIndex(desc.Digest)
+	}
+	digest, platforms, err = resolveDigest(image, &desc, index, platform)
+	return digest, platforms, true, err
+}
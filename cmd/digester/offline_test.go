@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/krm-functions/catalog/pkg/helm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOfflineLookup(t *testing.T) {
+	dir := t.TempDir()
+	p, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.AppendImage(img, layout.WithAnnotations(map[string]string{
+		"org.opencontainers.image.ref.name": "example.com/layout:1.0.0",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imgDigest, _ := img.Digest()
+
+	items, err := helm.ParseAsRNodes([]byte(`apiVersion: fn.kpt.dev/v1alpha1
+kind: DigestLock
+metadata:
+  name: digests
+digests:
+  example.com/locked:1.0.0: sha256:abc
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &FunctionConfig{LookupMode: LookupModeOffline, OCILayout: dir}
+	_ = cfg.Default()
+	imageFilter, _ := NewImageFilterFromConfig(cfg)
+	if err = imageFilter.loadOfflineSources(items); err != nil {
+		t.Fatal(err)
+	}
+	imageFilter.Images = []string{"example.com/locked:1.0.0", "example.com/layout:1.0.0", "example.com/unknown:1.0.0"}
+	imageFilter.LookupDigests()
+	assert.Equal(t, "sha256:abc", imageFilter.Digests["example.com/locked:1.0.0"])
+	assert.Equal(t, imgDigest.String(), imageFilter.Digests["example.com/layout:1.0.0"])
+	assert.Error(t, imageFilter.Errors["example.com/unknown:1.0.0"])
+
+	// Refreshing the lock replaces digests of an existing lock resource
+	items, err = writeDigestLock(items, map[string]string{"example.com/new:2.0.0": "sha256:def"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(items))
+	digests, err := readDigestLock(items[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{"example.com/new:2.0.0": "sha256:def"}, digests)
+
+	// A lock resource is created if none exist
+	items, err = writeDigestLock(nil, map[string]string{"example.com/new:2.0.0": "sha256:def"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(items))
+	assert.Equal(t, "digests.lock.yaml", items[0].GetAnnotations()["internal.config.kubernetes.io/path"])
+}
@@ -0,0 +1,178 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"sigs.k8s.io/kustomize/kyaml/fn/framework"
+	"sigs.k8s.io/kustomize/kyaml/kio/filters"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// ImagePinner rewrites image fields from 'repo:tag' to
+// 'repo:tag@digest' and split tag fields from 'tag' to 'tag@digest'.
+// Images with a tag upgrade are rewritten to the upgraded tag and its
+// digest
+type ImagePinner struct {
+	filter *ImageFilter
+	// Pin images without upgrades
+	pin bool
+	// Number of image fields pinned
+	Pinned int
+	// Number of image fields upgraded
+	Upgraded int
+}
+
+func (p *ImagePinner) VisitScalar(node *yaml.RNode, path string) error {
+	if !p.filter.isImagePath(path) {
+		return nil
+	}
+	image, upgraded := p.filter.upgraded(yaml.GetValue(node))
+	if upgraded {
+		node.YNode().Value = image
+		p.Upgraded++
+	}
+	if !p.pin && !upgraded {
+		return nil
+	}
+	if digest, found := p.filter.Digests[image]; found && digest != "" {
+		node.YNode().Value = image + "@" + digest
+		p.Pinned++
+	}
+	return nil
+}
+
+// VisitMapping pins images split into repository and tag fields by
+// rewriting the tag field from 'tag' to 'tag@digest'
+func (p *ImagePinner) VisitMapping(node *yaml.RNode, path string) error {
+	image, f := p.filter.repoTagImage(node, path)
+	if image == "" {
+		return nil
+	}
+	parts := splitImage(image)
+	if parts.tag == "" { // Digest-only tag fields are already pinned
+		return nil
+	}
+	tag := node.Field(f.Tag).Value.YNode()
+	image, upgraded := p.filter.upgraded(image)
+	if upgraded {
+		parts = splitImage(image)
+		tag.Value = parts.tag
+		p.Upgraded++
+	}
+	if !p.pin && !upgraded {
+		return nil
+	}
+	if digest, found := p.filter.Digests[image]; found && digest != "" {
+		tag.Value = parts.tag + "@" + digest
+		p.Pinned++
+	}
+	return nil
+}
+
+// manifestImages returns a filter holding the images to pin in
+// resources together with the resources. RenderHelmChart resources
+// and local-config resources are ignored
+func (i *ImageFilter) manifestImages(items []*yaml.RNode) (*ImageFilter, []*yaml.RNode, error) {
+	var manifests []*yaml.RNode
+	for _, item := range items {
+		if item.GetKind() == "RenderHelmChart" || item.GetAnnotations()[filters.LocalConfigAnnotation] == "true" {
+			continue
+		}
+		manifests = append(manifests, item)
+	}
+
+	pinFilter, err := NewImageFilterFromConfig(i.Config)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = pinFilter.Filter(manifests); err != nil {
+		return nil, nil, err
+	}
+	pinFilter.Images, err = selectImages(pinFilter.Images, i.Config.Include, i.Config.Exclude)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pinFilter, manifests, nil
+}
+
+// pinManifests pins images in-place in resources using digests already looked up
+func (i *ImageFilter) pinManifests(manifests []*yaml.RNode) ([]*framework.Result, error) {
+	var results []*framework.Result
+	pinner := &ImagePinner{filter: i, pin: i.Config == nil || i.Config.PinManifests}
+	for _, m := range manifests {
+		i.setObject(m)
+		if err := Walk(pinner, m, ""); err != nil {
+			return results, fmt.Errorf("pinning images in %v/%v: %w", m.GetKind(), m.GetName(), err)
+		}
+	}
+	results = append(results, i.ImageResults()...)
+	results = append(results, &framework.Result{
+		Message:  fmt.Sprintf("pinned %d and upgraded %d image fields in %d resources\n", pinner.Pinned, pinner.Upgraded, len(manifests)),
+		Severity: framework.Info,
+	})
+	return results, nil
+}
+
+// selectImages returns unique images matching an include pattern (if any) and no exclude patterns
+func selectImages(images, include, exclude []string) ([]string, error) {
+	incl, err := compileAll(include)
+	if err != nil {
+		return nil, err
+	}
+	excl, err := compileAll(exclude)
+	if err != nil {
+		return nil, err
+	}
+	var selected []string
+	seen := map[string]bool{}
+	for _, image := range images {
+		if seen[image] {
+			continue
+		}
+		seen[image] = true
+		if len(incl) > 0 && !matchAny(incl, image) {
+			continue
+		}
+		if matchAny(excl, image) {
+			continue
+		}
+		selected = append(selected, image)
+	}
+	return selected, nil
+}
+
+func compileAll(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse regexp: %v: %w", p, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+func matchAny(patterns []*regexp.Regexp, s string) bool {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
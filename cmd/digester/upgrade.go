@@ -0,0 +1,169 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/krm-functions/catalog/pkg/semver"
+	"sigs.k8s.io/kustomize/kyaml/fn/framework"
+)
+
+// UpgradeInfo describes the evaluation of an image tag upgrade
+type UpgradeInfo struct {
+	Current    string `json:"current,omitempty" yaml:"current,omitempty"`
+	Upgraded   string `json:"upgraded,omitempty" yaml:"upgraded,omitempty"`
+	Distance   string `json:"semverDistance,omitempty" yaml:"semverDistance,omitempty"`
+	Constraint string `json:"constraint" yaml:"constraint"`
+}
+
+// LookupUpgrades lists tags of images matching the 'imageUpgrades'
+// of the function config and finds the highest tag satisfying the
+// constraint. Upgraded images are added to the images of the filter,
+// such that their digests are looked up
+func (i *ImageFilter) LookupUpgrades() error {
+	if i.Config == nil || len(i.Config.ImageUpgrades) == 0 {
+		return nil
+	}
+	type candidate struct {
+		image      string
+		parts      imageParts
+		constraint string
+	}
+	var candidates []candidate
+	var repositories []string
+	seenImages, seenRepositories := map[string]bool{}, map[string]bool{}
+	for _, image := range i.Images {
+		if seenImages[image] {
+			continue
+		}
+		seenImages[image] = true
+		parts := splitImage(image)
+		if parts.tag == "" {
+			continue
+		}
+		for _, u := range i.Config.ImageUpgrades {
+			pattern, err := regexp.Compile(u.Image)
+			if err != nil {
+				return fmt.Errorf("cannot parse regexp: %v: %w", u.Image, err)
+			}
+			if !pattern.MatchString(image) {
+				continue
+			}
+			candidates = append(candidates, candidate{image, parts, u.Constraint})
+			if !seenRepositories[parts.repository] {
+				seenRepositories[parts.repository] = true
+				repositories = append(repositories, parts.repository)
+			}
+			break
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	if i.Config.LookupMode == LookupModeOffline {
+		for _, c := range candidates {
+			i.UpgradeErrors[c.image] = fmt.Errorf("tags cannot be listed when lookup mode is offline")
+		}
+		return nil
+	}
+
+	tags := map[string][]string{}
+	listErrors := map[string]error{}
+	opts := i.remoteOptions()
+	i.forEachImage(repositories, func(repository string) {
+		var list []string
+		repo, err := name.NewRepository(repository)
+		if err == nil {
+			list, err = remote.List(repo, opts...)
+		}
+		i.mu.Lock()
+		defer i.mu.Unlock()
+		tags[repository] = list
+		listErrors[repository] = err
+	})
+
+	for _, c := range candidates {
+		if err := listErrors[c.parts.repository]; err != nil {
+			i.UpgradeErrors[c.image] = fmt.Errorf("listing tags: %w", err)
+			continue
+		}
+		newTag, err := semver.Upgrade(tags[c.parts.repository], c.constraint)
+		if err != nil {
+			i.UpgradeErrors[c.image] = err
+			continue
+		}
+		info := UpgradeInfo{
+			Current:    c.parts.repository + ":" + c.parts.tag,
+			Upgraded:   c.parts.repository + ":" + newTag,
+			Constraint: c.constraint,
+		}
+		if distance, err := semver.Diff(c.parts.tag, newTag); err == nil {
+			info.Distance = distance
+		}
+		i.Upgrades[c.image] = info
+		if newTag != c.parts.tag {
+			i.Images = append(i.Images, info.Upgraded)
+		}
+	}
+	return nil
+}
+
+// upgraded returns the image to use for image, i.e. the upgraded image if an upgrade was found
+func (i *ImageFilter) upgraded(image string) (string, bool) {
+	if u, found := i.Upgrades[image]; found && u.Upgraded != u.Current {
+		return u.Upgraded, true
+	}
+	return image, false
+}
+
+// UpgradeResults returns a result per evaluated image upgrade
+func (i *ImageFilter) UpgradeResults() []*framework.Result {
+	var results []*framework.Result
+	seen := map[string]bool{}
+	for _, image := range i.Images {
+		if seen[image] {
+			continue
+		}
+		seen[image] = true
+		if err, found := i.UpgradeErrors[image]; found {
+			results = append(results, &framework.Result{
+				Message:  fmt.Sprintf("upgrade: %v: %v\n", image, err),
+				Severity: framework.Warning,
+			})
+			continue
+		}
+		info, found := i.Upgrades[image]
+		if !found {
+			continue
+		}
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false) // We do not use Marshal since constraints may have chars that get escaped, e.g. '>'
+		if err := enc.Encode(info); err != nil {
+			continue
+		}
+		results = append(results, &framework.Result{
+			Message:  buf.String(),
+			Severity: framework.Info,
+		})
+	}
+	return results
+}
@@ -0,0 +1,159 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/kustomize/kyaml/utils"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// chartImageList holds the images found in a chart
+type chartImageList struct {
+	name   string
+	images []string
+}
+
+// imageParts holds the values that can be set from an image
+type imageParts struct {
+	repository, tag, digest string
+}
+
+// splitImage splits an image into repository, tag and digest, e.g.
+// 'ghcr.io/example/app:1.0@sha256:abc' into 'ghcr.io/example/app',
+// '1.0' and 'sha256:abc'
+func splitImage(image string) imageParts {
+	p := imageParts{}
+	image, p.digest, _ = strings.Cut(image, "@")
+	p.repository = image
+	// Tags follow the last ':' after the last '/', which is not a registry port
+	if idx := strings.LastIndex(image, ":"); idx > strings.LastIndex(image, "/") {
+		p.repository, p.tag = image[:idx], image[idx+1:]
+	}
+	return p
+}
+
+// SetValues sets chart values according to the 'imageValues'
+// mappings of the function config
+func (i *ImageFilter) SetValues(node *yaml.RNode) (*yaml.RNode, error) { //nolint:unparam // return value is unused, but we want the common filter prototype
+	if i.Config == nil {
+		return node, nil
+	}
+	for _, m := range i.Config.ImageValues {
+		pattern, err := regexp.Compile(m.Image)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse regexp: %v: %w", m.Image, err)
+		}
+		matched := false
+		for idx, chart := range i.charts {
+			if m.Chart != "" && m.Chart != chart.name {
+				continue
+			}
+			parts, found, err := i.matchImage(pattern, chart.images)
+			if err != nil {
+				return nil, fmt.Errorf("chart %v: %w", chart.name, err)
+			}
+			if !found {
+				continue
+			}
+			matched = true
+			// Fixed order such that new values are added deterministically
+			values := []struct{ path, value string }{
+				{m.Repository, parts.repository},
+				{m.Tag, parts.tag},
+				{m.Digest, parts.digest},
+			}
+			if m.Digest != "" && parts.digest == "" && i.failPolicy() != FailPolicyKeepExisting {
+				// The existing digest is stale, since the image is unresolved
+				cleared, err := clearChartValue(node, idx, m.Digest)
+				if err != nil {
+					return nil, err
+				}
+				if cleared {
+					i.Cleared = append(i.Cleared, m.Image)
+				}
+			}
+			for _, v := range values {
+				if v.path == "" || v.value == "" { // Never blank out existing values
+					continue
+				}
+				if err := setChartValue(node, idx, v.path, v.value); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if !matched {
+			i.Unmatched = append(i.Unmatched, m.Image)
+		}
+	}
+	return node, nil
+}
+
+// matchImage returns the parts of images matching pattern, using
+// upgraded images where available. Multiple images may match if they
+// result in the same parts
+func (i *ImageFilter) matchImage(pattern *regexp.Regexp, images []string) (imageParts, bool, error) {
+	var match imageParts
+	found := false
+	for _, image := range images {
+		if !pattern.MatchString(image) {
+			continue
+		}
+		// Upgraded images are tag-only images with digests looked up separately
+		image, _ = i.upgraded(image)
+		parts := splitImage(image)
+		if parts.digest == "" {
+			parts.digest = i.Digests[image]
+		}
+		if found && parts != match {
+			return match, false, fmt.Errorf("pattern does not identify a unique image: %v", pattern)
+		}
+		match, found = parts, true
+	}
+	return match, found, nil
+}
+
+// setChartValue sets a value in the inline values of a chart of a RenderHelmChart resource
+func setChartValue(node *yaml.RNode, chartIdx int, path, value string) error {
+	fields := utils.SmarterPathSplitter(path, ".")
+	lookup := append([]string{"helmCharts", strconv.Itoa(chartIdx), "templateOptions", "values", "valuesInline"}, fields[:len(fields)-1]...)
+	parent, err := node.Pipe(yaml.LookupCreate(yaml.MappingNode, lookup...))
+	if err != nil {
+		return fmt.Errorf("looking up values path %v: %w", path, err)
+	}
+	if parent == nil {
+		return fmt.Errorf("values path %v not found", path)
+	}
+	return parent.PipeE(yaml.SetField(fields[len(fields)-1], yaml.NewStringRNode(value)))
+}
+
+// clearChartValue sets an existing non-empty value of a chart to an
+// empty string and returns whether the value was cleared
+func clearChartValue(node *yaml.RNode, chartIdx int, path string) (bool, error) {
+	fields := utils.SmarterPathSplitter(path, ".")
+	lookup := append([]string{"helmCharts", strconv.Itoa(chartIdx), "templateOptions", "values", "valuesInline"}, fields...)
+	value, err := node.Pipe(yaml.Lookup(lookup...))
+	if err != nil {
+		return false, fmt.Errorf("looking up values path %v: %w", path, err)
+	}
+	if value == nil || value.YNode().Kind != yaml.ScalarNode || value.YNode().Value == "" {
+		return false, nil
+	}
+	return true, setChartValue(node, chartIdx, path, "")
+}
@@ -0,0 +1,415 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/krm-functions/catalog/pkg/api"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+	"github.com/sigstore/sigstore/pkg/signature/dsse"
+	"github.com/sigstore/sigstore/pkg/signature/payload"
+	"sigs.k8s.io/kustomize/kyaml/fn/framework"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	// Annotation on cosign signature layers holding the base64 encoded signature of the layer
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+	// Payload type of in-toto attestations in cosign DSSE envelopes
+	inTotoPayloadType = "application/vnd.in-toto+json"
+)
+
+// inTotoStatement is the part of in-toto attestation statements used
+// to identify the attested image and the type of attestation
+type inTotoStatement struct {
+	PredicateType string `json:"predicateType"`
+	Subject       []struct {
+		Digest map[string]string `json:"digest"`
+	} `json:"subject"`
+}
+
+// dsseEnvelope is the part of DSSE envelopes holding the payload
+type dsseEnvelope struct {
+	PayloadType string `json:"payloadType"`
+	Payload     string `json:"payload"`
+}
+
+// readVerifier returns a verifier for the PEM encoded public key in a ConfigMap or Secret in items
+func readVerifier(ref *PublicKeyRef, items []*yaml.RNode) (signature.Verifier, error) {
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+	for _, item := range items {
+		if item.GetApiVersion() != "v1" || item.GetKind() != ref.Kind || item.GetName() != ref.Name {
+			continue
+		}
+		if ns := item.GetNamespace(); ns != namespace && (ns != "" || namespace != "default") {
+			continue
+		}
+		data, found := item.GetDataMap()[ref.Key]
+		if !found {
+			return nil, fmt.Errorf("key '%v' not found in %v %s/%s", ref.Key, ref.Kind, namespace, ref.Name)
+		}
+		if ref.Kind == "Secret" {
+			decoded, err := base64.StdEncoding.DecodeString(data)
+			if err != nil {
+				return nil, fmt.Errorf("decoding '%v' in Secret %s/%s: %w", ref.Key, namespace, ref.Name, err)
+			}
+			data = string(decoded)
+		}
+		publicKey, err := cryptoutils.UnmarshalPEMToPublicKey([]byte(data))
+		if err != nil {
+			return nil, fmt.Errorf("parsing '%v' of %v %s/%s: %w", ref.Key, ref.Kind, namespace, ref.Name, err)
+		}
+		return signature.LoadVerifier(publicKey, crypto.SHA256)
+	}
+	return nil, fmt.Errorf("public key %v %s/%s not found", ref.Kind, namespace, ref.Name)
+}
+
+// signedDigest returns the digest signatures of an image are attached
+// to. Images pinned to a platform are resolved to the manifest of the
+// platform, whereas signatures are attached to the image index, i.e.
+// the digest of the index of the image tag is returned if the index
+// holds the platform manifest
+func signedDigest(ref name.Reference, digest string, opts ...remote.Option) (string, error) {
+	desc, err := remote.Get(ref, opts...)
+	if err != nil {
+		return "", fmt.Errorf("reading image index: %w", err)
+	}
+	if desc.Digest.String() == digest || !desc.MediaType.IsIndex() {
+		return digest, nil
+	}
+	idx, err := desc.ImageIndex()
+	if err != nil {
+		return "", fmt.Errorf("reading image index: %w", err)
+	}
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return "", fmt.Errorf("reading image index: %w", err)
+	}
+	for _, m := range manifest.Manifests {
+		if m.Digest.String() == digest {
+			return desc.Digest.String(), nil
+		}
+	}
+	return "", fmt.Errorf("digest %v not found in image index %v", digest, desc.Digest)
+}
+
+// readLayers returns the annotations and content of the layers of the
+// image with the cosign tag '<repository>:sha256-<digest>.<suffix>'.
+// Found is false if the tag does not exist
+func readLayers(repo name.Repository, digest, suffix string, opts ...remote.Option) (annotations []map[string]string, contents [][]byte, found bool, err error) {
+	img, err := remote.Image(repo.Tag(strings.Replace(digest, ":", "-", 1)+"."+suffix), opts...)
+	var terr *transport.Error
+	if errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+		return nil, nil, false, nil
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	for idx := range manifest.Layers {
+		desc := &manifest.Layers[idx]
+		content, err := readLayer(img, desc)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		annotations = append(annotations, desc.Annotations)
+		contents = append(contents, content)
+	}
+	return annotations, contents, true, nil
+}
+
+func readLayer(img v1.Image, desc *v1.Descriptor) ([]byte, error) {
+	layer, err := img.LayerByDigest(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// verifySignature verifies that the image digest has a cosign
+// signature made with the private key of verifier, and that the
+// signature identifies the image repository and digest
+func verifySignature(ref name.Reference, digest string, verifier signature.Verifier, opts ...remote.Option) error {
+	annotations, payloads, found, err := readLayers(ref.Context(), digest, "sig", opts...)
+	if err != nil {
+		return fmt.Errorf("reading signatures: %w", err)
+	}
+	if !found {
+		return fmt.Errorf("no signatures found")
+	}
+	var errs []error
+	for idx := range payloads {
+		sig, found := annotations[idx][cosignSignatureAnnotation]
+		if !found {
+			continue
+		}
+		err = verifyPayload(payloads[idx], sig, ref.Context(), digest, verifier)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return fmt.Errorf("no signatures found")
+	}
+	return fmt.Errorf("no valid signature: %w", errors.Join(errs...))
+}
+
+// verifyPayload verifies a signature of a cosign payload and that the
+// payload identifies the repository and digest. The payload identity
+// prevents signatures from being copied between repositories
+func verifyPayload(b []byte, sig string, repo name.Repository, digest string, verifier signature.Verifier) error {
+	rawSig, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("decoding signature: %w", err)
+	}
+	if err = verifier.VerifySignature(bytes.NewReader(rawSig), bytes.NewReader(b)); err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+	p := payload.Cosign{}
+	if err = json.Unmarshal(b, &p); err != nil {
+		return fmt.Errorf("parsing signature payload: %w", err)
+	}
+	if p.Image.DigestStr() != digest {
+		return fmt.Errorf("signature is for digest %v", p.Image.DigestStr())
+	}
+	if p.Image.Repository.Name() != repo.Name() {
+		return fmt.Errorf("signature is for image %v", p.ClaimedIdentity)
+	}
+	return nil
+}
+
+// verifyAttestations returns the predicate types of cosign attestations
+// of the image digest made with the private key of verifier. Attestations
+// are read from the '<repository>:sha256-<digest>.att' tag. Attestations
+// without a valid signature or for other digests are ignored
+func verifyAttestations(ref name.Reference, digest string, verifier signature.Verifier, opts ...remote.Option) ([]string, error) {
+	_, envelopes, _, err := readLayers(ref.Context(), digest, "att", opts...)
+	if err != nil {
+		return nil, fmt.Errorf("reading attestations: %w", err)
+	}
+	var predicateTypes []string
+	dsseVerifier := dsse.WrapVerifier(verifier)
+	for _, envelope := range envelopes {
+		if dsseVerifier.VerifySignature(bytes.NewReader(envelope), nil) != nil {
+			continue
+		}
+		env := dsseEnvelope{}
+		if json.Unmarshal(envelope, &env) != nil || env.PayloadType != inTotoPayloadType {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(env.Payload)
+		if err != nil {
+			continue
+		}
+		statement := inTotoStatement{}
+		if json.Unmarshal(b, &statement) != nil {
+			continue
+		}
+		for _, subject := range statement.Subject {
+			if "sha256:"+subject.Digest["sha256"] == digest {
+				predicateTypes = append(predicateTypes, statement.PredicateType)
+				break
+			}
+		}
+	}
+	return predicateTypes, nil
+}
+
+// verifyImage verifies the signature of an image resolved to digest
+// and returns the predicate types of its attestations. With platform,
+// digest is the platform manifest and the index of the tag is verified
+func verifyImage(image, digest string, platform bool, verifier signature.Verifier, opts ...remote.Option) ([]string, error) {
+	base, _, pinned := strings.Cut(image, "@")
+	ref, err := name.ParseReference(base)
+	if err != nil {
+		return nil, err
+	}
+	if _, tagErr := name.NewTag(base, name.StrictValidation); platform && (!pinned || tagErr == nil) {
+		if digest, err = signedDigest(ref, digest, opts...); err != nil {
+			return nil, err
+		}
+	}
+	if err = verifySignature(ref, digest, verifier, opts...); err != nil {
+		return nil, err
+	}
+	return verifyAttestations(ref, digest, verifier, opts...)
+}
+
+// VerifySignatures verifies signatures and attestations of resolved and pinned images
+func (i *ImageFilter) VerifySignatures(items []*yaml.RNode) error {
+	verifier, err := readVerifier(&i.Config.VerifySignatures.PublicKey, items)
+	if err != nil {
+		return err
+	}
+	var images []string
+	digests := map[string]string{}
+	for _, image := range i.Images {
+		digest := i.Digests[image]
+		if _, d, found := strings.Cut(image, "@"); found {
+			digest = d
+		}
+		if _, found := digests[image]; found || digest == "" {
+			continue
+		}
+		digests[image] = digest
+		images = append(images, image)
+	}
+	if i.Config.LookupMode == LookupModeOffline {
+		for _, image := range images {
+			i.Signatures[image] = fmt.Errorf("signatures cannot be verified when lookup mode is offline")
+		}
+		return nil
+	}
+	opts := i.remoteOptions()
+	platform := i.Config.Platform != ""
+	i.forEachImage(images, func(image string) {
+		attestations, err := verifyImage(image, digests[image], platform, verifier, opts...)
+		i.mu.Lock()
+		defer i.mu.Unlock()
+		i.Signatures[image] = err
+		if len(attestations) > 0 {
+			i.Attestations[image] = attestations
+		}
+	})
+	return nil
+}
+
+// SignatureResults returns a result per image with signature verification status
+func (i *ImageFilter) SignatureResults() []*framework.Result {
+	severity := framework.Error
+	if i.Config != nil && i.Config.VerifySignatures != nil && i.Config.VerifySignatures.Mode == VerifyModeAnnotate {
+		severity = framework.Warning
+	}
+	var results []*framework.Result
+	for _, image := range i.signedImages() {
+		if err := i.Signatures[image]; err != nil {
+			results = append(results, &framework.Result{
+				Message:  fmt.Sprintf("signature: %v: not verified: %v\n", image, err),
+				Severity: severity,
+			})
+		} else {
+			var attestations string
+			if a := i.Attestations[image]; len(a) > 0 {
+				attestations = fmt.Sprintf(" (attestations: %v)", strings.Join(a, ", "))
+			}
+			results = append(results, &framework.Result{
+				Message:  fmt.Sprintf("signature: %v: verified%v\n", image, attestations),
+				Severity: framework.Info,
+			})
+		}
+	}
+	return results
+}
+
+// SignatureFailures returns the number of images without a valid signature
+func (i *ImageFilter) SignatureFailures() int {
+	failures := 0
+	for _, image := range i.signedImages() {
+		if i.Signatures[image] != nil {
+			failures++
+		}
+	}
+	return failures
+}
+
+// imageVerification is the verification status of an image in the
+// signatures annotation
+type imageVerification struct {
+	// 'verified' or the verification error
+	Signature    string   `json:"signature"`
+	Attestations []string `json:"attestations,omitempty"`
+}
+
+// AnnotateSignatures annotates a resource with the signature
+// verification status and attestations of images. Resources without
+// verified images are not annotated
+func (i *ImageFilter) AnnotateSignatures(node *yaml.RNode) error {
+	status := map[string]imageVerification{}
+	for _, image := range i.signedImages() {
+		v := imageVerification{Signature: "verified", Attestations: i.Attestations[image]}
+		if err := i.Signatures[image]; err != nil {
+			v.Signature = err.Error()
+		}
+		status[image] = v
+	}
+	if len(status) == 0 {
+		return nil
+	}
+	value, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return node.PipeE(yaml.SetAnnotation(api.HelmResourceAnnotationImageSignatures, string(value)))
+}
+
+// AnnotateManifestSignatures annotates plain manifests with the
+// signature verification status of the images they hold. Manifests
+// must be annotated before images are pinned
+func (i *ImageFilter) AnnotateManifestSignatures(manifests []*yaml.RNode) error {
+	for _, m := range manifests {
+		manifestFilter, err := NewImageFilterFromConfig(i.Config)
+		if err != nil {
+			return err
+		}
+		if _, err = manifestFilter.Filter([]*yaml.RNode{m}); err != nil {
+			return err
+		}
+		manifestFilter.Signatures = i.Signatures
+		manifestFilter.Attestations = i.Attestations
+		if err = manifestFilter.AnnotateSignatures(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signedImages returns the unique images of this filter for which signatures have been verified
+func (i *ImageFilter) signedImages() []string {
+	var images []string
+	seen := map[string]bool{}
+	for _, image := range i.Images {
+		if _, found := i.Signatures[image]; found && !seen[image] {
+			seen[image] = true
+			images = append(images, image)
+		}
+	}
+	return images
+}
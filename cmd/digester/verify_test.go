@@ -0,0 +1,229 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/krm-functions/catalog/pkg/helm"
+	"github.com/sigstore/sigstore/pkg/signature"
+	"github.com/sigstore/sigstore/pkg/signature/dsse"
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// pushCosignLayer appends a layer to the cosign tag of digest in repository of image
+func pushCosignLayer(t *testing.T, image, digest, suffix string, layer []byte, mediaType types.MediaType, annotations map[string]string) {
+	t.Helper()
+	ref, _ := name.ParseReference(image)
+	tag := ref.Context().Tag(strings.Replace(digest, ":", "-", 1) + "." + suffix)
+	base, err := remote.Image(tag)
+	if err != nil {
+		base = empty.Image
+	}
+	img, err := mutate.Append(base, mutate.Addendum{
+		Layer:       static.NewLayer(layer, mediaType),
+		Annotations: annotations,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = remote.Write(tag, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pushSignature pushes a cosign signature of digest made with key to
+// the repository of image. The signature claims the identity of
+// identity, e.g. the repository of image
+func pushSignature(t *testing.T, image, identity, digest string, key *ecdsa.PrivateKey) {
+	t.Helper()
+	payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":%q},"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`,
+		identity, digest))
+	signer, err := signature.LoadECDSASigner(key, crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := signer.SignMessage(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushCosignLayer(t, image, digest, "sig", payload, "application/vnd.dev.cosign.simplesigning.v1+json",
+		map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sig)})
+}
+
+// pushAttestation pushes a cosign in-toto attestation of digest made with key
+func pushAttestation(t *testing.T, image, digest, predicateType string, key *ecdsa.PrivateKey) {
+	t.Helper()
+	statement := []byte(fmt.Sprintf(`{"_type":"https://in-toto.io/Statement/v0.1","predicateType":%q,"subject":[{"name":"image","digest":{"sha256":%q}}],"predicate":{}}`,
+		predicateType, strings.TrimPrefix(digest, "sha256:")))
+	signer, err := signature.LoadECDSASigner(key, crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := dsse.WrapSigner(signer, inTotoPayloadType).SignMessage(bytes.NewReader(statement))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushCosignLayer(t, image, digest, "att", envelope, "application/vnd.dsse.envelope.v1+json", nil)
+}
+
+// publicKeyItems returns a ConfigMap 'cosign-key' holding the public key of key
+func publicKeyItems(t *testing.T, key *ecdsa.PrivateKey) []*yaml.RNode {
+	t.Helper()
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	pub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	items, err := helm.ParseAsRNodes([]byte(fmt.Sprintf(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: cosign-key
+data:
+  cosign.pub: |
+%s`, "    "+strings.ReplaceAll(strings.TrimSpace(string(pub)), "\n", "\n    "))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return items
+}
+
+func TestVerifySignatures(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	digests := map[string]string{}
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, repo := range []string{"signed", "unsigned", "badsig", "copied"} {
+		image := host + "/" + repo + ":1.0.0"
+		ref, _ := name.ParseReference(image)
+		if err = remote.Write(ref, img); err != nil {
+			t.Fatal(err)
+		}
+		d, _ := img.Digest()
+		digests[image] = d.String()
+	}
+	signed := host + "/signed:1.0.0"
+	pushSignature(t, signed, host+"/signed", digests[signed], key)
+	pushAttestation(t, signed, digests[signed], "https://slsa.dev/provenance/v0.2", key)
+	pushAttestation(t, signed, digests[signed], "https://example.com/untrusted", otherKey)
+	pushSignature(t, host+"/badsig:1.0.0", host+"/badsig", digests[host+"/badsig:1.0.0"], otherKey)
+	// Valid signature of the same image, but for another repository
+	pushSignature(t, host+"/copied:1.0.0", host+"/signed", digests[host+"/copied:1.0.0"], key)
+
+	cfg := &FunctionConfig{VerifySignatures: &SignatureVerification{PublicKey: PublicKeyRef{Name: "cosign-key"}}}
+	_ = cfg.Default()
+	imageFilter, _ := NewImageFilterFromConfig(cfg)
+	for image, digest := range digests {
+		imageFilter.Images = append(imageFilter.Images, image)
+		imageFilter.Digests[image] = digest
+	}
+	if err = imageFilter.VerifySignatures(publicKeyItems(t, key)); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, imageFilter.Signatures[signed])
+	assert.Equal(t, []string{"https://slsa.dev/provenance/v0.2"}, imageFilter.Attestations[signed])
+	assert.ErrorContains(t, imageFilter.Signatures[host+"/unsigned:1.0.0"], "no signatures found")
+	assert.ErrorContains(t, imageFilter.Signatures[host+"/badsig:1.0.0"], "invalid signature")
+	assert.ErrorContains(t, imageFilter.Signatures[host+"/copied:1.0.0"], "signature is for image "+host+"/signed")
+	assert.Equal(t, 3, imageFilter.SignatureFailures())
+
+	obj, _ := helm.ParseAsRNodes([]byte("apiVersion: experimental.helm.sh/v1alpha1\nkind: RenderHelmChart\nmetadata:\n  name: chart\n"))
+	if err = imageFilter.AnnotateSignatures(obj[0]); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, obj[0].GetAnnotations()["experimental.helm.sh/image-signatures"],
+		`"`+signed+`":{"signature":"verified","attestations":["https://slsa.dev/provenance/v0.2"]}`)
+
+	// Plain manifests are annotated with the images they hold
+	manifests, _ := helm.ParseAsRNodes([]byte(fmt.Sprintf(`apiVersion: v1
+kind: Pod
+metadata:
+  name: signed
+spec:
+  containers:
+  - name: app
+    image: %s
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: no-images
+`, signed)))
+	if err = imageFilter.AnnotateManifestSignatures(manifests); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, manifests[0].GetAnnotations()["experimental.helm.sh/image-signatures"], `"`+signed+`":{"signature":"verified"`)
+	assert.NotContains(t, manifests[0].GetAnnotations()["experimental.helm.sh/image-signatures"], "unsigned")
+	assert.Empty(t, manifests[1].GetAnnotations())
+}
+
+func TestVerifySignaturesPlatform(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	image := strings.TrimPrefix(server.URL, "http://") + "/multiarch:1.0.0"
+
+	amd64, _ := random.Image(64, 1)
+	arm64, _ := random.Image(64, 1)
+	idx := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: amd64, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}},
+		mutate.IndexAddendum{Add: arm64, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}}})
+	ref, _ := name.ParseReference(image)
+	if err := remote.WriteIndex(ref, idx); err != nil {
+		t.Fatal(err)
+	}
+	indexDigest, _ := idx.Digest()
+	armDigest, _ := arm64.Digest()
+
+	// Signatures are attached to the index, not the platform manifest
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	pushSignature(t, image, ref.Context().Name(), indexDigest.String(), key)
+
+	cfg := &FunctionConfig{Platform: "linux/arm64", VerifySignatures: &SignatureVerification{PublicKey: PublicKeyRef{Name: "cosign-key"}}}
+	_ = cfg.Default()
+	imageFilter, _ := NewImageFilterFromConfig(cfg)
+	imageFilter.Images = []string{image}
+	imageFilter.Digests[image] = armDigest.String()
+	if err := imageFilter.VerifySignatures(publicKeyItems(t, key)); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, imageFilter.Signatures[image])
+}
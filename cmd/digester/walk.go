@@ -24,10 +24,20 @@ type Visitor interface {
 	VisitScalar(node *yaml.RNode, path string) error
 }
 
+// MappingVisitor is optionally implemented by visitors that also need to visit mapping nodes
+type MappingVisitor interface {
+	VisitMapping(node *yaml.RNode, path string) error
+}
+
 // Walk visits all nodes in the RNode through recursive traversal
 func Walk(v Visitor, object *yaml.RNode, path string) error {
 	switch object.YNode().Kind {
 	case yaml.MappingNode:
+		if mv, ok := v.(MappingVisitor); ok {
+			if err := mv.VisitMapping(object, path); err != nil {
+				return fmt.Errorf("visiting mapping: %w", err)
+			}
+		}
 		return object.VisitFields(func(node *yaml.MapNode) error {
 			return Walk(v, node.Value, path+"."+node.Key.YNode().Value)
 		})
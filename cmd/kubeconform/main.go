@@ -17,9 +17,8 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"regexp"
 
-	"github.com/krm-functions/catalog/pkg/util"
+	"github.com/krm-functions/catalog/pkg/kubeconform"
 	"github.com/krm-functions/catalog/pkg/version"
 
 	"github.com/yannh/kubeconform/pkg/resource"
@@ -30,18 +29,8 @@ import (
 	"sigs.k8s.io/kustomize/kyaml/yaml"
 )
 
-type Data struct {
-	KubernetesVersion    string `yaml:"kubernetes_version,omitempty" json:"kubernetes_version,omitempty"`
-	IgnoreMissingSchemas string `yaml:"ignore_missing_schemas,omitempty" json:"ignore_missing_schemas,omitempty"`
-	Strict               string `yaml:"strict,omitempty" json:"strict,omitempty"`
-	SchemaLocations      string `yaml:"schema_locations,omitempty" json:"schema_locations,omitempty"`
-	SkipKinds            string `yaml:"skip_kinds,omitempty" json:"skip_kinds,omitempty"`
-	RejectKinds          string `yaml:"reject_kinds,omitempty" json:"reject_kinds,omitempty"`
-	Debug                string `yaml:"debug,omitempty" json:"debug,omitempty"`
-}
-
 type FunctionConfig struct {
-	Data Data `yaml:"data,omitempty" json:"data,omitempty"`
+	Data kubeconform.Config `yaml:"data,omitempty" json:"data,omitempty"`
 }
 
 type Stats struct {
@@ -58,44 +47,13 @@ type FilterState struct {
 	Stats
 }
 
-const (
-	StringTrue  = "true"
-	StringFalse = "false"
-)
-
 func (fnCfg *FunctionConfig) Default() error { //nolint:unparam // this return is part of the Defaulter interface
-	if fnCfg.Data.KubernetesVersion == "" {
-		fnCfg.Data.KubernetesVersion = "master"
-	}
-	if fnCfg.Data.IgnoreMissingSchemas == "" {
-		fnCfg.Data.IgnoreMissingSchemas = StringFalse
-	}
-	if fnCfg.Data.Strict == "" {
-		fnCfg.Data.Strict = StringTrue
-	}
-	if fnCfg.Data.SchemaLocations == "" {
-		fnCfg.Data.SchemaLocations = os.Getenv("KUBECONFORM_SCHEMA_LOCATIONS")
-	}
-	if fnCfg.Data.Debug == "" {
-		fnCfg.Data.Debug = StringFalse
-	}
+	fnCfg.Data.Default()
 	return nil
 }
 
 func (fnCfg *FunctionConfig) Validate() error {
-	if fnCfg.Data.KubernetesVersion != "master" {
-		match, err := regexp.MatchString("^[0-9]+\\.[0-9]+\\.[0-9]+$", fnCfg.Data.KubernetesVersion)
-		if err != nil || !match {
-			return fmt.Errorf("illegal 'ignore_missing_schemas' argument: %s", fnCfg.Data.KubernetesVersion)
-		}
-	}
-	if fnCfg.Data.IgnoreMissingSchemas != StringTrue && fnCfg.Data.IgnoreMissingSchemas != StringFalse {
-		return fmt.Errorf("illegal 'ignore_missing_schemas' argument: %s", fnCfg.Data.IgnoreMissingSchemas)
-	}
-	if fnCfg.Data.Strict != StringTrue && fnCfg.Data.Strict != StringFalse {
-		return fmt.Errorf("illegal 'strict' argument: %s", fnCfg.Data.Strict)
-	}
-	return nil
+	return fnCfg.Data.Validate()
 }
 
 func (f *FilterState) Each(items []*yaml.RNode) ([]*yaml.RNode, error) {
@@ -171,25 +129,9 @@ func Processor() framework.ResourceListProcessor {
 		if err := framework.LoadFunctionConfig(rl.FunctionConfig, config); err != nil {
 			return fmt.Errorf("reading function-config: %w", err)
 		}
-		opts := validator.Opts{
-			Debug:                config.Data.Debug == StringTrue,
-			KubernetesVersion:    config.Data.KubernetesVersion,
-			Strict:               config.Data.Strict == StringTrue,
-			IgnoreMissingSchemas: config.Data.IgnoreMissingSchemas == StringTrue,
-		}
-		var schemas []string
-		if config.Data.SchemaLocations != "" {
-			schemas = util.CsvToList(config.Data.SchemaLocations)
-		}
-		if config.Data.SkipKinds != "" {
-			opts.SkipKinds = csvToKindMap(config.Data.SkipKinds)
-		}
-		if config.Data.RejectKinds != "" {
-			opts.RejectKinds = csvToKindMap(config.Data.RejectKinds)
-		}
-		v, err := validator.New(schemas, opts)
+		v, err := config.Data.NewValidator()
 		if err != nil {
-			return fmt.Errorf("initializing validator: %s", err)
+			return err
 		}
 		filter := FilterState{
 			fnConfig:  config,
@@ -204,14 +146,6 @@ func Processor() framework.ResourceListProcessor {
 	})
 }
 
-func csvToKindMap(cvs string) map[string]struct{} {
-	kinds := make(map[string]struct{})
-	for _, itm := range util.CsvToList(cvs) {
-		kinds[itm] = struct{}{}
-	}
-	return kinds
-}
-
 func main() {
 	cmd := command.Build(Processor(), command.StandaloneEnabled, false)
 
@@ -0,0 +1,82 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
+	"github.com/krm-functions/catalog/pkg/git"
+	"github.com/krm-functions/catalog/pkg/util"
+)
+
+const (
+	// Environment variable with the directory of git mirrors
+	cacheDirEnv = "PACKAGE_CACHE_DIR"
+	// Mirrors not used within this age are removed
+	defaultCacheMaxAge = 30 * 24 * time.Hour
+)
+
+// cacheDir returns the directory of a persistent cache of git mirrors,
+// given by the environment or the function configuration. An empty
+// directory means no persistent cache, i.e. mirrors are only kept for
+// the duration of the run
+func cacheDir(fnConfig *fn.KubeObject) string {
+	if dir := os.Getenv(cacheDirEnv); dir != "" {
+		return dir
+	}
+	if fnConfig != nil {
+		if val, found, err := fnConfig.NestedString("data", "cacheDir"); err == nil && found {
+			return val
+		}
+	}
+	return ""
+}
+
+// cacheMaxAge returns the age of unused mirrors to remove. Zero
+// disables removal
+func cacheMaxAge(fnConfig *fn.KubeObject) (time.Duration, error) {
+	maxAge := defaultCacheMaxAge
+	if fnConfig != nil {
+		if val, found, err := fnConfig.NestedString("data", "cacheMaxAge"); err == nil && found {
+			maxAge, err = time.ParseDuration(val)
+			if err != nil {
+				return 0, fmt.Errorf("invalid cacheMaxAge %q: %w", val, err)
+			}
+		}
+	}
+	if maxAge < 0 {
+		return 0, fmt.Errorf("cacheMaxAge cannot be negative, got %v", maxAge)
+	}
+	return maxAge, nil
+}
+
+// pruneCache removes mirrors not used within maxAge. Failures are
+// reported as warnings since the cache is not required for composition
+func pruneCache(dir string, maxAge time.Duration) fn.Results {
+	var fnResults fn.Results
+	if maxAge == 0 {
+		return fnResults
+	}
+	removed, err := git.PruneMirrors(dir, maxAge)
+	for _, uri := range removed {
+		util.ResultPrintf(&fnResults, fn.Info, "removed mirror of %v, unused for %v", uri, maxAge)
+	}
+	if err != nil {
+		util.ResultPrintf(&fnResults, fn.Warning, "pruning mirror cache %v: %v", dir, err)
+	}
+	return fnResults
+}
@@ -0,0 +1,107 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/krm-functions/catalog/pkg/git/gittest"
+	a "github.com/stretchr/testify/assert"
+)
+
+// configMap returns a ConfigMap with a single value
+func configMap(value string) string {
+	return "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm\ndata:\n  value: " + value + "\n"
+}
+
+func gitFleet(repo, ref string) string {
+	return fmt.Sprintf(`apiVersion: fn.kpt.dev/v1alpha1
+kind: Fleet
+metadata:
+  name: example-fleet
+  annotations:
+    internal.config.kubernetes.io/path: fleet/fleet.yaml
+spec:
+  upstreams:
+  - name: example
+    type: git
+    git:
+      repo: %s
+  packages:
+  - name: foo
+    ref: %s
+    sourcePath: pkg1
+`, repo, ref)
+}
+
+func TestGitMirrorCache(t *testing.T) {
+	repoDir := t.TempDir()
+	repo, err := gogit.PlainInit(repoDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := gittest.CommitFiles(t, repo, repoDir, map[string]string{"pkg1/cm.yaml": configMap("one")})
+	if _, err = repo.CreateTag("v1.0", plumbing.NewHash(first), nil); err != nil {
+		t.Fatal(err)
+	}
+	second := gittest.CommitFiles(t, repo, repoDir, map[string]string{"pkg1/cm.yaml": configMap("two")})
+	cache := t.TempDir()
+	t.Setenv(cacheDirEnv, cache)
+
+	for _, tc := range []struct {
+		ref    string
+		value  string
+		commit string
+	}{
+		{"master", "two", second},
+		{"v1.0", "one", first},
+		{first, "one", first},
+	} {
+		rl := compose(t, gitFleet(repoDir, tc.ref), "")
+		cm, lock := composed(t, rl)
+		value, _, _ := cm.NestedString("data", "value")
+		a.Equal(t, tc.value, value, tc.ref)
+		a.Equal(t, tc.commit, lock.Spec.Packages[0].Commit, tc.ref)
+		a.Contains(t, rl.Results.String(), "updated mirror of "+repoDir)
+	}
+	entries, err := os.ReadDir(cache)
+	a.NoError(t, err)
+	a.Len(t, entries, 2) // The mirror and its lock file
+
+	// Unused mirrors are removed
+	old := time.Now().Add(-2 * defaultCacheMaxAge)
+	a.NoError(t, os.Chtimes(filepath.Join(cache, entries[0].Name(), "mirror-used"), old, old))
+	fnResults := pruneCache(cache, defaultCacheMaxAge)
+	a.Contains(t, fnResults.String(), "removed mirror of "+repoDir)
+	a.NoDirExists(t, filepath.Join(cache, entries[0].Name()))
+}
+
+func TestCacheDir(t *testing.T) {
+	t.Setenv(cacheDirEnv, "")
+	a.Equal(t, "", cacheDir(nil)) // No persistent cache by default
+	cfg, err := fn.ParseKubeObject([]byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cfg\ndata:\n  cacheDir: /var/cache/mirrors\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Equal(t, "/var/cache/mirrors", cacheDir(cfg))
+	t.Setenv(cacheDirEnv, "/tmp/mirrors")
+	a.Equal(t, "/tmp/mirrors", cacheDir(cfg))
+}
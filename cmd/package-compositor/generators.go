@@ -0,0 +1,127 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"slices"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+	"github.com/krm-functions/catalog/pkg/util"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// PackageGenerator expands a package template over a list or a matrix
+// of parameters. Parameters are added to 'metadata.spec' of the
+// generated packages
+type PackageGenerator struct {
+	// Parameter sets, a package is generated for each entry
+	List []map[string]string `yaml:"list,omitempty" json:"list,omitempty"`
+	// Parameter values, a package is generated for each combination
+	Matrix map[string][]string `yaml:"matrix,omitempty" json:"matrix,omitempty"`
+	// Package template. 'name' and 'sourcePath' are templates rendered with the parameters
+	Template Package `yaml:"template,omitempty" json:"template,omitempty"`
+}
+
+// ExpandGenerators appends the packages generated by the generators of
+// a Fleet to the top-level packages. Package names are validated after
+// expansion
+func (fleet *Fleet) ExpandGenerators() error {
+	if len(fleet.Spec.Generators) == 0 {
+		return nil
+	}
+	for idx := range fleet.Spec.Generators {
+		g := &fleet.Spec.Generators[idx]
+		params, err := g.parameters()
+		if err != nil {
+			return fmt.Errorf("generator %v: %w", idx, err)
+		}
+		for _, param := range params {
+			p, err := g.generate(param)
+			if err != nil {
+				return fmt.Errorf("generator %v: %w", idx, err)
+			}
+			fleet.Spec.Packages = append(fleet.Spec.Packages, *p)
+		}
+	}
+	return nil
+}
+
+// parameters returns the parameter sets of a generator. Matrix
+// combinations are ordered by parameter name
+func (g *PackageGenerator) parameters() ([]map[string]string, error) {
+	if (len(g.List) > 0) == (len(g.Matrix) > 0) {
+		return nil, fmt.Errorf("generator requires one of 'list' or 'matrix'")
+	}
+	if len(g.List) > 0 {
+		return g.List, nil
+	}
+	params := []map[string]string{{}}
+	for _, key := range slices.Sorted(maps.Keys(g.Matrix)) {
+		if len(g.Matrix[key]) == 0 {
+			return nil, fmt.Errorf("matrix parameter %q has no values", key)
+		}
+		var expanded []map[string]string
+		for _, param := range params {
+			for _, val := range g.Matrix[key] {
+				combination := maps.Clone(param)
+				combination[key] = val
+				expanded = append(expanded, combination)
+			}
+		}
+		params = expanded
+	}
+	return params, nil
+}
+
+// generate returns a package from the template for a parameter set
+func (g *PackageGenerator) generate(params map[string]string) (*Package, error) {
+	if _, found := params["name"]; found {
+		return nil, fmt.Errorf("parameters cannot have 'name' field")
+	}
+	// The template is copied since defaulting modifies package metadata
+	b, err := yaml.Marshal(&g.Template)
+	if err != nil {
+		return nil, err
+	}
+	p := &Package{}
+	if err = yaml.Unmarshal(b, p); err != nil {
+		return nil, err
+	}
+	p.Name, err = renderParams(g.Template.Name, params)
+	if err != nil {
+		return nil, fmt.Errorf("rendering package name: %w", err)
+	}
+	p.SrcPath, err = renderParams(g.Template.SrcPath, params)
+	if err != nil {
+		return nil, fmt.Errorf("rendering package %v sourcePath: %w", p.Name, err)
+	}
+	p.Metadata.Spec = util.MergeMaps(p.Metadata.Spec, params)
+	return p, nil
+}
+
+func renderParams(tpl string, params map[string]string) (string, error) {
+	t, err := template.New("tpl").Option("missingkey=error").Funcs(sprig.TxtFuncMap()).Parse(tpl)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err = t.Execute(&out, params); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
+	"github.com/krm-functions/catalog/pkg/api"
+	"sigs.k8s.io/kustomize/kyaml/kio/filters"
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	FleetLockKind = "FleetLock"
+
+	// Use locked commits when present and lock new packages
+	LockModeLocked = "locked"
+	// Re-resolve all package refs and update the lock
+	LockModeUpdate = "update"
+)
+
+// FleetLock records the resolved commit of each package of a Fleet
+type FleetLock struct {
+	Spec FleetLockSpec `yaml:"spec,omitempty" json:"spec,omitempty"`
+}
+
+type FleetLockSpec struct {
+	Packages []PackageLock `yaml:"packages,omitempty" json:"packages,omitempty"`
+}
+
+type PackageLock struct {
+	// Package destination path relative to the Fleet
+	Package  string     `yaml:"package" json:"package"`
+	Upstream UpstreamID `yaml:"upstream" json:"upstream"`
+	Ref      SourceRef  `yaml:"ref" json:"ref"`
+	// Tag resolved from a semver constraint ref
+	Tag string `yaml:"tag,omitempty" json:"tag,omitempty"`
+	// Git commit, OCI digest or chart sum
+	Commit string `yaml:"commit" json:"commit"`
+	// Package source path within the upstream
+	SourcePath string `yaml:"sourcePath,omitempty" json:"sourcePath,omitempty"`
+}
+
+// lookup returns the lock of a package, or nil if the package is not
+// locked or locked with another upstream or ref
+func (l *FleetLock) lookup(pkg string, upstream UpstreamID, ref SourceRef) *PackageLock {
+	if pl := l.entry(pkg); pl != nil && pl.Upstream == upstream && pl.Ref == ref {
+		return pl
+	}
+	return nil
+}
+
+// entry returns the lock of a package irrespective of upstream and ref
+func (l *FleetLock) entry(pkg string) *PackageLock {
+	for idx := range l.Spec.Packages {
+		if l.Spec.Packages[idx].Package == pkg {
+			return &l.Spec.Packages[idx]
+		}
+	}
+	return nil
+}
+
+func (l *FleetLock) set(pl PackageLock) {
+	if prev := l.entry(pl.Package); prev != nil {
+		*prev = pl
+		return
+	}
+	l.Spec.Packages = append(l.Spec.Packages, pl)
+	sort.Slice(l.Spec.Packages, func(i, j int) bool { return l.Spec.Packages[i].Package < l.Spec.Packages[j].Package })
+}
+
+func lockMode(fnConfig *fn.KubeObject) (string, error) {
+	mode := LockModeLocked
+	if fnConfig != nil {
+		if val, found, err := fnConfig.NestedString("data", "lockMode"); err == nil && found {
+			mode = val
+		}
+	}
+	if mode != LockModeLocked && mode != LockModeUpdate {
+		return "", fmt.Errorf("invalid lockMode %q", mode)
+	}
+	return mode, nil
+}
+
+// lockPath returns the path of the lock resource of a Fleet
+func lockPath(fleetDir, fleetName string) string {
+	return filepath.Join(fleetDir, fleetName+".lock.yaml")
+}
+
+// findFleetLock returns the lock resource of a Fleet or nil if not found
+func findFleetLock(items fn.KubeObjects, fleetDir, fleetName string) *fn.KubeObject {
+	for _, item := range items {
+		if item.IsGVK(api.KptResourceAPI, "", FleetLockKind) && item.GetName() == fleetName &&
+			filepath.Dir(item.GetAnnotation(kioutil.PathAnnotation)) == fleetDir {
+			return item
+		}
+	}
+	return nil
+}
+
+func ParseFleetLock(object []byte) (*FleetLock, error) {
+	lock := &FleetLock{}
+	if err := yaml.Unmarshal(object, lock); err != nil {
+		return nil, fmt.Errorf("parsing %v: %w", FleetLockKind, err)
+	}
+	return lock, nil
+}
+
+// writeFleetLock updates the lock resource of a Fleet in the
+// ResourceList. A lock resource is created if none exist
+func writeFleetLock(rl *fn.ResourceList, fleetDir, fleetName string, lock *FleetLock) error {
+	obj := findFleetLock(rl.Items, fleetDir, fleetName)
+	if obj == nil && len(lock.Spec.Packages) == 0 {
+		return nil // e.g. only local upstreams
+	}
+	if obj == nil {
+		obj = fn.NewEmptyKubeObject()
+		if err := obj.SetAPIVersion(api.KptResourceAPI + "/v1alpha1"); err != nil {
+			return err
+		}
+		if err := obj.SetKind(FleetLockKind); err != nil {
+			return err
+		}
+		if err := obj.SetName(fleetName); err != nil {
+			return err
+		}
+		if err := obj.SetAnnotation(filters.LocalConfigAnnotation, "true"); err != nil {
+			return err
+		}
+		if err := obj.SetAnnotation(kioutil.PathAnnotation, lockPath(fleetDir, fleetName)); err != nil {
+			return err
+		}
+		rl.Items = append(rl.Items, obj)
+	}
+	return obj.SetNestedField(lock.Spec.Packages, "spec", "packages")
+}
@@ -0,0 +1,167 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	a "github.com/stretchr/testify/assert"
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
+)
+
+// pushPackage pushes an OCI artifact with a single ConfigMap and returns its digest
+func pushPackage(t *testing.T, image, data string) string {
+	t.Helper()
+	return pushPackageAt(t, image, "pkg1", data)
+}
+
+// pushPackageAt pushes an OCI artifact with a single ConfigMap in
+// srcPath and returns its digest
+func pushPackageAt(t *testing.T, image, srcPath, data string) string {
+	t.Helper()
+	img, err := crane.Image(map[string][]byte{
+		srcPath + "/cm.yaml": []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm\ndata:\n" + data),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return digest.String()
+}
+
+// compose runs the function on input with the given lock mode
+func compose(t *testing.T, input, mode string) *fn.ResourceList {
+	t.Helper()
+	objs, err := fn.ParseKubeObjects([]byte(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := &fn.ResourceList{Items: objs}
+	if mode != "" {
+		rl.FunctionConfig, err = fn.ParseKubeObject([]byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cfg\ndata:\n  lockMode: " + mode + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("LOCAL_PACKAGES_DIR", t.TempDir())
+	ok, err := Run(rl)
+	if !ok || err != nil {
+		t.Fatalf("Expected Run to succeed: %v", err)
+	}
+	return rl
+}
+
+// composed returns the ConfigMap of package 'foo' and the resulting lock
+func composed(t *testing.T, rl *fn.ResourceList) (*fn.KubeObject, *FleetLock) {
+	t.Helper()
+	var cm *fn.KubeObject
+	var fleetLock *FleetLock
+	for _, o := range rl.Items {
+		switch o.GetAnnotation(kioutil.PathAnnotation) {
+		case "fleet/example-fleet/foo/cm.yaml":
+			a.Nil(t, cm, "duplicate ConfigMap")
+			cm = o
+		case "fleet/example-fleet.lock.yaml":
+			var err error
+			fleetLock, err = ParseFleetLock([]byte(o.String()))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return cm, fleetLock
+}
+
+func ociFleet(image string) string {
+	return fmt.Sprintf(`apiVersion: fn.kpt.dev/v1alpha1
+kind: Fleet
+metadata:
+  name: example-fleet
+  annotations:
+    internal.config.kubernetes.io/path: fleet/fleet.yaml
+spec:
+  upstreams:
+  - name: oci
+    type: oci
+    oci:
+      image: %s
+  packages:
+  - name: foo
+    ref: v1
+    sourcePath: pkg1
+`, image)
+}
+
+func TestFleetLock(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	image := strings.TrimPrefix(server.URL, "http://") + "/packages"
+	fleet := ociFleet(image)
+
+	digest1 := pushPackage(t, image+":v1", "  value: one\n")
+	cm, lock := composed(t, compose(t, fleet, ""))
+	value, _, _ := cm.NestedString("data", "value")
+	a.Equal(t, "one", value)
+	a.Equal(t, []PackageLock{{Package: "foo", Upstream: "oci", Ref: "v1", Commit: digest1, SourcePath: "pkg1"}}, lock.Spec.Packages)
+
+	lockYaml := fmt.Sprintf(`---
+apiVersion: fn.kpt.dev/v1alpha1
+kind: FleetLock
+metadata:
+  name: example-fleet
+  annotations:
+    internal.config.kubernetes.io/path: fleet/example-fleet.lock.yaml
+spec:
+  packages:
+  - package: foo
+    upstream: oci
+    ref: v1
+    commit: %s
+`, digest1)
+
+	// Tag moved, locked digest is used
+	digest2 := pushPackage(t, image+":v1", "  value: two\n")
+	cm, lock = composed(t, compose(t, fleet+lockYaml, LockModeLocked))
+	value, _, _ = cm.NestedString("data", "value")
+	a.Equal(t, "one", value)
+	a.Equal(t, digest1, lock.Spec.Packages[0].Commit)
+
+	// Update mode re-resolves refs and reports moved packages
+	rl := compose(t, fleet+lockYaml, LockModeUpdate)
+	cm, lock = composed(t, rl)
+	value, _, _ = cm.NestedString("data", "value")
+	a.Equal(t, "two", value)
+	a.Equal(t, digest2, lock.Spec.Packages[0].Commit)
+	a.Contains(t, rl.Results.String(), "package foo moved")
+}
@@ -14,19 +14,24 @@
 package main
 
 import (
+	"encoding/base64"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 
 	"github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
 	"github.com/krm-functions/catalog/pkg/api"
+	"github.com/krm-functions/catalog/pkg/git"
 	"github.com/krm-functions/catalog/pkg/util"
 	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
 )
 
+const knownHostsKey = "known_hosts"
+
 func Run(rl *fn.ResourceList) (bool, error) {
 	results := &rl.Results
-	sources := make([]PackageSource, 0)
+	sources := make([]*PackageSource, 0)
 
 	var base, srcBase, dstBase string
 	base = os.Getenv("LOCAL_PACKAGES_DIR")
@@ -40,6 +45,25 @@ func Run(rl *fn.ResourceList) (bool, error) {
 	}
 	srcBase = base + "/in"
 	dstBase = base + "/out"
+	mirrorBase := cacheDir(rl.FunctionConfig)
+	persistentCache := mirrorBase != ""
+	if !persistentCache {
+		mirrorBase = base + "/cache"
+	}
+
+	mode, er := lockMode(rl.FunctionConfig)
+	if er != nil {
+		return false, er
+	}
+	limit, er := concurrency(rl.FunctionConfig)
+	if er != nil {
+		return false, er
+	}
+	maxAge, er := cacheMaxAge(rl.FunctionConfig)
+	if er != nil {
+		return false, er
+	}
+	var merged fn.KubeObjects
 
 	for _, kubeObject := range rl.Items {
 		if !kubeObject.IsGVK(api.KptResourceAPI, "", "Fleet") {
@@ -50,37 +74,44 @@ func Run(rl *fn.ResourceList) (bool, error) {
 		if err != nil {
 			return false, err
 		}
-		for idx := range fleet.Spec.Upstreams {
-			var er error
-			u := &fleet.Spec.Upstreams[idx]
-			if PackageSourceLookup(sources, u) != nil {
-				continue
-			}
-
-			var username, password string
-			username = "git"
-			if u.Git.Auth != nil {
-				username, password, err = util.LookupSSHAuthSecret(u.Git.Auth.Name, u.Git.Auth.Namespace, rl)
-				if err != nil {
-					return false, err
-				}
-			}
-
-			src, fnRes, er := NewPackageSource(u, srcBase, username, password)
-			if er != nil {
-				return false, er
+		objPath := filepath.Dir(kubeObject.GetAnnotation(kioutil.PathAnnotation))
+		fleet.ResolveLocalUpstreams(objPath)
+		fleet.existing = rl.Items
+		fleet.lockMode = mode
+		fleet.concurrency = limit
+		fleet.lock = &FleetLock{}
+		fleet.newLock = &FleetLock{}
+		if lockObj := findFleetLock(rl.Items, objPath, kubeObject.GetName()); lockObj != nil {
+			fleet.lock, err = ParseFleetLock([]byte(lockObj.String()))
+			if err != nil {
+				return false, err
 			}
-			*results = append(*results, fnRes...)
-			sources = append(sources, *src)
 		}
-		objPath := filepath.Dir(kubeObject.GetAnnotation(kioutil.PathAnnotation))
+		var fnResults fn.Results
+		sources, fnResults, err = addSources(fleet, sources, rl, srcBase, mirrorBase)
+		*results = append(*results, fnResults...)
+		if err != nil {
+			return false, err
+		}
 		fleetBaseDir := filepath.Join(objPath, kubeObject.GetName())
-		fnResults, err := fleet.TossFiles(sources, fleet.Spec.Packages, dstBase, fleetBaseDir)
+		fnResults, err = fleet.TossFiles(sources, fleet.Spec.Packages, dstBase, fleetBaseDir)
 		if err != nil {
 			return false, err
 		}
 		*results = append(*results, fnResults...)
+		merged = append(merged, fleet.merged...)
+		err = writeFleetLock(rl, objPath, kubeObject.GetName(), fleet.newLock)
+		if err != nil {
+			return false, err
+		}
 	}
+	if persistentCache {
+		*results = append(*results, pruneCache(mirrorBase, maxAge)...)
+	}
+	// Existing packages are replaced by the merged packages
+	rl.Items = slices.DeleteFunc(rl.Items, func(o *fn.KubeObject) bool {
+		return slices.Contains(merged, o)
+	})
 	nodes, err := FilesystemToObjects(dstBase)
 	if err != nil {
 		return false, err
@@ -97,6 +128,126 @@ func Run(rl *fn.ResourceList) (bool, error) {
 	return true, nil
 }
 
+// addSources adds sources for the upstreams of a Fleet not already
+// found in sources. Upstreams are cloned and fetched concurrently
+func addSources(fleet *Fleet, sources []*PackageSource, rl *fn.ResourceList, srcBase, mirrorBase string) ([]*PackageSource, fn.Results, error) {
+	var fnResults fn.Results
+	type credentials struct {
+		username, password, knownHosts string
+	}
+	var pending []*Upstream
+	var creds []credentials
+	for idx := range fleet.Spec.Upstreams {
+		u := &fleet.Spec.Upstreams[idx]
+		if PackageSourceLookup(sources, u) != nil || slices.ContainsFunc(pending, u.sameSource) {
+			continue
+		}
+		if u.Type == api.PackageUpstreamTypeLocal {
+			src, err := NewLocalPackageSource(u, srcBase, rl.Items)
+			if err != nil {
+				return sources, fnResults, err
+			}
+			sources = append(sources, src)
+			continue
+		}
+		username, password, knownHosts, err := lookupCredentials(u, rl)
+		if err != nil {
+			return sources, fnResults, err
+		}
+		pending = append(pending, u)
+		creds = append(creds, credentials{username, password, knownHosts})
+	}
+
+	added := make([]*PackageSource, len(pending))
+	addResults := make([]fn.Results, len(pending))
+	addErrs := make([]error, len(pending))
+	forEach(fleet.concurrency, len(pending), func(idx int) {
+		c := creds[idx]
+		added[idx], addResults[idx], addErrs[idx] = NewPackageSource(pending[idx], srcBase, mirrorBase, c.username, c.password, c.knownHosts)
+	})
+	for idx := range pending {
+		fnResults = append(fnResults, addResults[idx]...)
+		if addErrs[idx] != nil {
+			return sources, fnResults, addErrs[idx]
+		}
+		sources = append(sources, added[idx])
+	}
+	return sources, fnResults, nil
+}
+
+// lookupCredentials returns credentials and SSH known hosts of an upstream
+func lookupCredentials(u *Upstream, rl *fn.ResourceList) (username, password, knownHosts string, err error) {
+	switch u.Type {
+	case api.PackageUpstreamTypeOCI:
+		if u.OCI.Auth != nil {
+			username, password, err = util.LookupAuthSecret(u.OCI.Auth.Name, u.OCI.Auth.Namespace, rl)
+		}
+		return username, password, "", err
+	case api.PackageUpstreamTypeHelmChart:
+		if u.HelmChart.Auth != nil {
+			username, password, err = util.LookupAuthSecret(u.HelmChart.Auth.Name, u.HelmChart.Auth.Namespace, rl)
+		}
+		return username, password, "", err
+	}
+	username = "git"
+	if u.Git.Auth != nil {
+		switch u.Git.AuthMethod {
+		case git.AuthMethodHTTPSBasic:
+			username, password, err = util.LookupAuthSecret(u.Git.Auth.Name, u.Git.Auth.Namespace, rl)
+		case git.AuthMethodHTTPSToken:
+			_, password, err = util.LookupAuthSecretWithKeys(u.Git.Auth.Name, u.Git.Auth.Namespace, "token", "token", rl)
+		default:
+			username, password, err = util.LookupSSHAuthSecret(u.Git.Auth.Name, u.Git.Auth.Namespace, rl)
+		}
+		if err != nil {
+			return "", "", "", err
+		}
+	}
+	if u.Git.KnownHosts != nil {
+		knownHosts, err = LookupKnownHosts(u.Git.KnownHosts, rl)
+		if err != nil {
+			return "", "", "", err
+		}
+	}
+	return username, password, knownHosts, nil
+}
+
+// LookupKnownHosts returns the 'known_hosts' key of a Secret or ConfigMap
+func LookupKnownHosts(ref *Auth, rl *fn.ResourceList) (string, error) {
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = "default" // Default according to spec
+	}
+	for _, k := range rl.Items {
+		if !k.IsGVK("v1", "", ref.Kind) || k.GetName() != ref.Name {
+			continue
+		}
+		oNamespace := k.GetNamespace()
+		if oNamespace == "" {
+			oNamespace = "default"
+		}
+		if oNamespace != namespace {
+			continue
+		}
+		value, found, err := k.NestedString("data", knownHostsKey)
+		if err != nil {
+			return "", err
+		}
+		if !found {
+			return "", fmt.Errorf("key '%v' not found in %v %s/%s", knownHostsKey, ref.Kind, namespace, ref.Name)
+		}
+		if ref.Kind == "Secret" {
+			decoded, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return "", fmt.Errorf("decoding '%v' in Secret %s/%s: %w", knownHostsKey, namespace, ref.Name, err)
+			}
+			value = string(decoded)
+		}
+		return value, nil
+	}
+	return "", fmt.Errorf("known hosts %v %s/%s not found", ref.Kind, namespace, ref.Name)
+}
+
 func main() {
 	if err := fn.AsMain(fn.ResourceListProcessorFunc(Run)); err != nil {
 		os.Exit(1)
@@ -0,0 +1,178 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
+	"sigs.k8s.io/kustomize/kyaml/kio"
+	"sigs.k8s.io/kustomize/kyaml/kio/filters"
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// Files read when merging packages
+var mergeFilesGlob = []string{"*.yaml", "*.yml", "Kptfile"}
+
+// Conflict is a resource where fields were modified both locally and
+// upstream. Upstream values take precedence in the merge
+type Conflict struct {
+	Resource string
+	Fields   []string
+}
+
+// collectLocalPackages groups items by the output package they are
+// located in, i.e. the existing destination packages. The deepest
+// package wins, such that sub-packages are not part of their parent
+func collectLocalPackages(items fn.KubeObjects, packages PackageSlice) map[string]fn.KubeObjects {
+	local := map[string]fn.KubeObjects{}
+	for _, item := range items {
+		path := item.GetAnnotation(kioutil.PathAnnotation)
+		owner := ""
+		for idx := range packages {
+			p := &packages[idx]
+			if strings.HasPrefix(path, p.dstAbsPath+"/") && len(p.dstAbsPath) > len(owner) {
+				owner = p.dstAbsPath
+			}
+		}
+		if owner != "" {
+			local[owner] = append(local[owner], item)
+		}
+	}
+	return local
+}
+
+// writeLocalPackage writes the resources of an existing destination package to dir
+func writeLocalPackage(dir, pkgAbsPath string, items fn.KubeObjects) error {
+	var nodes []*yaml.RNode
+	for _, item := range items {
+		rel, err := filepath.Rel(pkgAbsPath, item.GetAnnotation(kioutil.PathAnnotation))
+		if err != nil {
+			return err
+		}
+		node, err := relocate(item, rel)
+		if err != nil {
+			return err
+		}
+		nodes = append(nodes, node)
+	}
+	return writeResources(dir, nodes)
+}
+
+// mergePackage performs a three-way merge of the original upstream,
+// updated upstream and local package. The result is written to the
+// local package directory
+func mergePackage(originalDir, updatedDir, localDir string) ([]Conflict, error) {
+	var resources [3]map[string]*yaml.RNode
+	for idx, dir := range []string{originalDir, updatedDir, localDir} {
+		var err error
+		resources[idx], err = readResources(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	conflicts := findConflicts(resources[0], resources[1], resources[2])
+
+	m := filters.Merge3{
+		OriginalPath:   originalDir,
+		UpdatedPath:    updatedDir,
+		DestPath:       localDir,
+		MatchFilesGlob: mergeFilesGlob,
+	}
+	if err := m.Merge(); err != nil {
+		return nil, fmt.Errorf("merging package: %w", err)
+	}
+	return conflicts, nil
+}
+
+// readResources reads the resources of a directory indexed by resource identity
+func readResources(dir string) (map[string]*yaml.RNode, error) {
+	r := kio.LocalPackageReader{
+		PackagePath:           dir,
+		MatchFilesGlob:        mergeFilesGlob,
+		OmitReaderAnnotations: true,
+	}
+	nodes, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	resources := map[string]*yaml.RNode{}
+	for _, n := range nodes {
+		resources[resourceID(n)] = n
+	}
+	return resources, nil
+}
+
+func resourceID(n *yaml.RNode) string {
+	id := n.GetApiVersion() + "/" + n.GetKind() + "/"
+	if ns := n.GetNamespace(); ns != "" {
+		id += ns + "/"
+	}
+	return id + n.GetName()
+}
+
+// findConflicts returns resources with fields that have been modified
+// both locally and upstream to different values
+func findConflicts(original, updated, local map[string]*yaml.RNode) []Conflict {
+	var conflicts []Conflict
+	for id, l := range local {
+		o, u := original[id], updated[id]
+		if o == nil || u == nil {
+			continue
+		}
+		oValues, uValues, lValues := map[string]string{}, map[string]string{}, map[string]string{}
+		fieldValues(o.YNode(), "", oValues)
+		fieldValues(u.YNode(), "", uValues)
+		fieldValues(l.YNode(), "", lValues)
+		var fields []string
+		for field, lv := range lValues {
+			ov, inOriginal := oValues[field]
+			uv, inUpdated := uValues[field]
+			if inOriginal && inUpdated && lv != ov && uv != ov && lv != uv {
+				fields = append(fields, field)
+			}
+		}
+		if len(fields) > 0 {
+			sort.Strings(fields)
+			conflicts = append(conflicts, Conflict{Resource: id, Fields: fields})
+		}
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Resource < conflicts[j].Resource })
+	return conflicts
+}
+
+// fieldValues flattens the scalar fields of a node into a map from field path to value
+func fieldValues(node *yaml.Node, path string, values map[string]string) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, n := range node.Content {
+			fieldValues(n, path, values)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			fieldValues(node.Content[i+1], path+"."+node.Content[i].Value, values)
+		}
+	case yaml.SequenceNode:
+		for i, n := range node.Content {
+			fieldValues(n, fmt.Sprintf("%s[%d]", path, i), values)
+		}
+	case yaml.ScalarNode:
+		values[path] = node.Value
+	default: // Aliases are not compared
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
+	"github.com/google/go-containerregistry/pkg/registry"
+	a "github.com/stretchr/testify/assert"
+)
+
+func TestMergeLocalModifications(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	image := strings.TrimPrefix(server.URL, "http://") + "/packages"
+	fleet := ociFleet(image)
+
+	pushPackage(t, image+":v1", "  value: one\n  other: one\n")
+	rl := compose(t, fleet, "")
+
+	// Local modifications of the composed package
+	cm, _ := composed(t, rl)
+	a.NoError(t, cm.SetNestedField("mine", "data", "local"))
+	a.NoError(t, cm.SetNestedField("local", "data", "other"))
+
+	pushPackage(t, image+":v1", "  value: two\n  other: two\n")
+	rl = compose(t, rl.Items.String(), LockModeUpdate)
+	cm, _ = composed(t, rl)
+	if cm == nil {
+		t.Fatal("ConfigMap of package 'foo' not found")
+	}
+	value, _, _ := cm.NestedString("data", "value")
+	a.Equal(t, "two", value, "upstream change")
+	value, _, _ = cm.NestedString("data", "local")
+	a.Equal(t, "mine", value, "local change")
+	value, _, _ = cm.NestedString("data", "other")
+	a.Equal(t, "two", value, "conflicting change")
+	a.Contains(t, rl.Results.String(), "conflict in v1/ConfigMap/cm, upstream values used for .data.other")
+}
+
+// withFleet returns the items of a composed ResourceList with the Fleet replaced by fleet
+func withFleet(rl *fn.ResourceList, fleet string) string {
+	items := rl.Items.Where(func(o *fn.KubeObject) bool { return o.GetKind() != "Fleet" })
+	return fleet + "---\n" + items.String()
+}
+
+func TestMergeMovedPackage(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	image := strings.TrimPrefix(server.URL, "http://") + "/packages"
+
+	pushPackage(t, image+":v1", "  value: one\n  other: one\n")
+	rl := compose(t, ociFleet(image), "")
+	cm, _ := composed(t, rl)
+	a.NoError(t, cm.SetNestedField("local", "data", "other"))
+
+	// The package moved upstream, the original is read from the locked source path
+	pushPackageAt(t, image+":v2", "pkg2", "  value: two\n  other: one\n")
+	fleet := strings.NewReplacer("ref: v1", "ref: v2", "sourcePath: pkg1", "sourcePath: pkg2").Replace(ociFleet(image))
+	rl = compose(t, withFleet(rl, fleet), "")
+	cm, lock := composed(t, rl)
+	if cm == nil {
+		t.Fatal("ConfigMap of package 'foo' not found")
+	}
+	value, _, _ := cm.NestedString("data", "value")
+	a.Equal(t, "two", value, "upstream change")
+	value, _, _ = cm.NestedString("data", "other")
+	a.Equal(t, "local", value, "local change")
+	a.NotContains(t, rl.Results.String(), "conflict")
+	a.Equal(t, "pkg2", lock.Spec.Packages[0].SourcePath)
+}
+
+func TestMergeRemovedUpstream(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	image := strings.TrimPrefix(server.URL, "http://") + "/packages"
+
+	pushPackage(t, image+":v1", "  value: one\n")
+	rl := compose(t, ociFleet(image), "")
+	cm, _ := composed(t, rl)
+	a.NoError(t, cm.SetNestedField("mine", "data", "local"))
+
+	// The locked upstream is no longer in the Fleet
+	rl = compose(t, withFleet(rl, fmt.Sprintf(`apiVersion: fn.kpt.dev/v1alpha1
+kind: Fleet
+metadata:
+  name: example-fleet
+  annotations:
+    internal.config.kubernetes.io/path: fleet/fleet.yaml
+spec:
+  upstreams:
+  - name: renamed
+    type: oci
+    oci:
+      image: %s
+  packages:
+  - name: foo
+    ref: v1
+    sourcePath: pkg1
+`, image)), "")
+	cm, _ = composed(t, rl)
+	if cm == nil {
+		t.Fatal("ConfigMap of package 'foo' not found")
+	}
+	value, _, _ := cm.NestedString("data", "local")
+	a.Equal(t, "mine", value, "local change")
+	a.Contains(t, rl.Results.String(), "previous upstream oci not found")
+}
+
+func TestCollectOriginalWithoutSource(t *testing.T) {
+	fleet, err := ParseFleetSpec([]byte(ociFleet("example.com/packages")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fleet.lock = &FleetLock{Spec: FleetLockSpec{Packages: []PackageLock{{Package: "foo", Upstream: "oci", Ref: "v1", Commit: "sha256:abc"}}}}
+	fnResults, err := fleet.collectOriginal(nil, &fleet.Spec.Packages[0], "foo", t.TempDir())
+	a.NoError(t, err)
+	a.Contains(t, fnResults.String(), "previous upstream oci not found")
+}
@@ -18,10 +18,14 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"path/filepath"
 	"slices"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"text/template"
 	"time"
 
@@ -37,12 +41,27 @@ import (
 
 type Fleet struct {
 	Spec FleetSpec `yaml:"spec,omitempty" json:"spec,omitempty"`
+	// Previous lock, nil if locking is not used
+	lock     *FleetLock
+	lockMode string
+	// Lock resulting from composing the Fleet
+	newLock *FleetLock
+	// Existing resources, possibly from a previous composition
+	existing fn.KubeObjects
+	// Existing resources merged into output packages
+	merged fn.KubeObjects
+	// Number of concurrent upstream fetches and package operations
+	concurrency int
+	// Guards newLock when packages are produced concurrently
+	mu sync.Mutex
 }
 
 type FleetSpec struct {
 	Upstreams []Upstream      `yaml:"upstreams,omitempty" json:"upstreams,omitempty"`
 	Defaults  PackageDefaults `yaml:"defaults,omitempty" json:"defaults,omitempty"`
 	Packages  PackageSlice    `yaml:"packages,omitempty" json:"packages,omitempty"`
+	// Generators of top-level packages, appended to 'packages'
+	Generators []PackageGenerator `yaml:"generators,omitempty" json:"generators,omitempty"`
 }
 
 type PackageSlice []Package
@@ -57,9 +76,12 @@ type UpstreamID string
 type SourceRef string
 
 type Upstream struct {
-	Name UpstreamID  `yaml:"name,omitempty" json:"name,omitempty"`
-	Type string      `yaml:"type,omitempty" json:"type,omitempty"`
-	Git  UpstreamGit `yaml:"git,omitempty" json:"git,omitempty"`
+	Name      UpstreamID        `yaml:"name,omitempty" json:"name,omitempty"`
+	Type      string            `yaml:"type,omitempty" json:"type,omitempty"`
+	Git       UpstreamGit       `yaml:"git,omitempty" json:"git,omitempty"`
+	OCI       UpstreamOCI       `yaml:"oci,omitempty" json:"oci,omitempty"`
+	HelmChart UpstreamHelmChart `yaml:"helmChart,omitempty" json:"helmChart,omitempty"`
+	Local     UpstreamLocal     `yaml:"local,omitempty" json:"local,omitempty"`
 }
 
 type Auth struct {
@@ -72,6 +94,35 @@ type UpstreamGit struct {
 	Repo       string `yaml:"repo,omitempty" json:"repo,omitempty"`
 	AuthMethod string `yaml:"authMethod,omitempty" json:"authMethod,omitempty"`
 	Auth       *Auth  `yaml:"auth,omitempty" json:"auth,omitempty"`
+	// Secret or ConfigMap with 'known_hosts' key used to verify SSH host keys
+	KnownHosts *Auth `yaml:"knownHosts,omitempty" json:"knownHosts,omitempty"`
+}
+
+// UpstreamOCI is a repository of kpt packages published as OCI
+// artifacts. Package 'ref' is the artifact tag or digest
+type UpstreamOCI struct {
+	Image string `yaml:"image,omitempty" json:"image,omitempty"`
+	// Secret with 'username' and 'password' keys
+	Auth *Auth `yaml:"auth,omitempty" json:"auth,omitempty"`
+}
+
+// UpstreamHelmChart is a Helm chart. Package 'ref' is the chart
+// version and the package contains a RenderHelmChart resource with
+// the embedded chart
+type UpstreamHelmChart struct {
+	Repo string `yaml:"repo,omitempty" json:"repo,omitempty"`
+	Name string `yaml:"name,omitempty" json:"name,omitempty"`
+	// Secret with 'username' and 'password' keys
+	Auth *Auth `yaml:"auth,omitempty" json:"auth,omitempty"`
+}
+
+// UpstreamLocal is a directory relative to the Fleet resource. Packages
+// are sourced from the resources of the ResourceList, i.e. package
+// 'ref' is not used
+type UpstreamLocal struct {
+	Directory string `yaml:"directory,omitempty" json:"directory,omitempty"`
+	// Directory relative to the package tree root, i.e. resolved from the Fleet path
+	path string
 }
 
 type PackageDefaults struct {
@@ -90,6 +141,11 @@ type Package struct {
 	Stub     *bool        `yaml:"stub,omitempty" json:"stub,omitempty"`
 	Metadata Metadata     `yaml:"metadata,omitempty" json:"metadata,omitempty"`
 	Packages PackageSlice `yaml:"packages,omitempty" json:"packages,omitempty"`
+
+	// Functions added to the Kptfile pipeline
+	Pipeline *PackagePipeline `yaml:"pipeline,omitempty" json:"pipeline,omitempty"`
+	// Setters from metadata, applied by the Kptfile pipeline
+	Setters *PackageSetters `yaml:"setters,omitempty" json:"setters,omitempty"`
 	// Relative path of where to store package. Generally identical to 'Name'
 	dstRelPath string
 	// hierarchical path, i.e. including parent package paths
@@ -108,24 +164,35 @@ type Metadata struct {
 }
 
 type PackageSource struct {
-	Type     string
-	CurrRef  SourceRef
-	Upstream *UpstreamGit
-	Git      *git.Repository
-	Username string
-	Password string
-	Path     string // Local absolute path to repo files
-	refs     []SourceRef
+	Type      string
+	Upstream  *UpstreamGit
+	Git       *git.Repository
+	OCI       *UpstreamOCI
+	HelmChart *UpstreamHelmChart
+	Local     *UpstreamLocal
+	Username  string
+	Password  string
+	Path      string // Local absolute path to files of local sources
+	base      string // Local base path, with a sub-directory per git commit or OCI and Helm chart ref
+	mu        sync.Mutex
+	fetches   map[string]*fetch // Fetched commits and refs
+	refs      []SourceRef
 }
 
-func (packages PackageSlice) Validate() error {
+func (packages PackageSlice) Validate(fleet *Fleet) error {
+	names := map[string]bool{}
 	for idx := range packages {
 		p := &packages[idx]
 		if p.Name == "" {
 			return fmt.Errorf("packages must have 'name' (index %v)", idx)
 		}
+		if names[p.Name] { // Packages would share a destination
+			return fmt.Errorf("duplicate package name %q", p.Name)
+		}
+		names[p.Name] = true
 		if !*p.Stub {
-			if p.Ref == "" {
+			u := UpstreamLookup(fleet, p.Upstream)
+			if p.Ref == "" && (u == nil || u.Type != api.PackageUpstreamTypeLocal) {
 				return fmt.Errorf("Package %q has no 'ref'", p.Name)
 			}
 			if p.SrcPath == "" {
@@ -137,7 +204,15 @@ func (packages PackageSlice) Validate() error {
 		if p.Upstream == "" {
 			return fmt.Errorf("Package %q has no upstream", p.Name)
 		}
-		if err := p.Packages.Validate(); err != nil { // Recursively validate packages
+		if p.Pipeline != nil {
+			if err := p.Pipeline.Validate(); err != nil {
+				return fmt.Errorf("Package %q: %w", p.Name, err)
+			}
+		}
+		if p.Setters != nil && p.Setters.Image == "" {
+			return fmt.Errorf("Package %q setters require 'image'", p.Name)
+		}
+		if err := p.Packages.Validate(fleet); err != nil { // Recursively validate packages
 			return err
 		}
 	}
@@ -149,16 +224,35 @@ func (fleet *Fleet) Validate() error {
 	for idx := range fleet.Spec.Upstreams {
 		u := &fleet.Spec.Upstreams[idx]
 		names = append(names, string(u.Name))
-		if u.Type == api.PackageUpstreamTypeGit {
+		switch u.Type {
+		case api.PackageUpstreamTypeOCI:
+			if u.OCI.Image == "" {
+				return fmt.Errorf("upstream %v, oci upstream require 'image'", u.Name)
+			}
+			if u.OCI.Auth != nil && u.OCI.Auth.Kind != "Secret" {
+				return fmt.Errorf("upstream %v, only auth kind 'Secret' supported", u.Name)
+			}
+		case api.PackageUpstreamTypeHelmChart:
+			if u.HelmChart.Repo == "" || u.HelmChart.Name == "" {
+				return fmt.Errorf("upstream %v, helmChart upstream require 'repo' and 'name'", u.Name)
+			}
+			if u.HelmChart.Auth != nil && u.HelmChart.Auth.Kind != "Secret" {
+				return fmt.Errorf("upstream %v, only auth kind 'Secret' supported", u.Name)
+			}
+		case api.PackageUpstreamTypeLocal:
+			if u.Local.Directory == "" {
+				return fmt.Errorf("upstream %v, local upstream require 'directory'", u.Name)
+			}
+		case api.PackageUpstreamTypeGit:
 			switch u.Git.AuthMethod {
 			case "":
-			case "sshAgent":
+			case git.AuthMethodSSHAgent:
 				if u.Git.Auth != nil {
 					return fmt.Errorf("upstream %v, cannot use auth specification with method 'sshAgent'", u.Name)
 				}
-			case "sshPrivateKey":
+			case git.AuthMethodSSHPrivateKey, git.AuthMethodHTTPSToken, git.AuthMethodHTTPSBasic:
 				if u.Git.Auth == nil {
-					return fmt.Errorf("upstream %v, auth method 'sshPrivateKey' require auth specification", u.Name)
+					return fmt.Errorf("upstream %v, auth method '%v' require auth specification", u.Name, u.Git.AuthMethod)
 				}
 				if u.Git.Auth.Kind != "Secret" {
 					return fmt.Errorf("upstream %v, only auth kind 'Secret' supported", u.Name)
@@ -166,6 +260,16 @@ func (fleet *Fleet) Validate() error {
 			default:
 				return fmt.Errorf("upstream %v, unsupported auth method: %v", u.Name, u.Git.AuthMethod)
 			}
+			if kh := u.Git.KnownHosts; kh != nil {
+				if u.Git.AuthMethod != git.AuthMethodSSHAgent && u.Git.AuthMethod != git.AuthMethodSSHPrivateKey {
+					return fmt.Errorf("upstream %v, known hosts require an SSH auth method", u.Name)
+				}
+				if kh.Kind != "Secret" && kh.Kind != "ConfigMap" {
+					return fmt.Errorf("upstream %v, only known hosts kind 'Secret' and 'ConfigMap' supported", u.Name)
+				}
+			}
+		default:
+			return fmt.Errorf("upstream %v, unsupported type: %v", u.Name, u.Type)
 		}
 	}
 	if len(util.UniqueStrings(names)) != len(names) {
@@ -181,7 +285,7 @@ func (fleet *Fleet) Validate() error {
 			return fmt.Errorf("upstream names must be unique")
 		}
 	}
-	return fleet.Spec.Packages.Validate()
+	return fleet.Spec.Packages.Validate(fleet)
 }
 
 func (fleet *Fleet) Default(packages PackageSlice, parentMeta Metadata) {
@@ -219,8 +323,9 @@ func (fleet *Fleet) Default(packages PackageSlice, parentMeta Metadata) {
 			p.Metadata.mergedSpec = util.MergeMaps(parentMeta.mergedSpec, p.Metadata.Spec)
 			p.Metadata.mergedTemplated = util.MergeMaps(parentMeta.mergedTemplated, p.Metadata.Templated)
 		} else {
-			p.Metadata.mergedSpec = p.Metadata.Spec
-			p.Metadata.mergedTemplated = p.Metadata.Templated
+			// Copied since rendering templated metadata updates the merged spec
+			p.Metadata.mergedSpec = maps.Clone(p.Metadata.Spec)
+			p.Metadata.mergedTemplated = maps.Clone(p.Metadata.Templated)
 		}
 		p.dstRelPath = p.Name
 		fleet.Default(p.Packages, p.Metadata) // Recursively default packages
@@ -235,14 +340,16 @@ func (packages PackageSlice) Print(w io.Writer) {
 	}
 }
 
-func (p *Package) renderTemplateMeta(src *PackageSource, dstPath string) error {
-	data := map[string]string{
+func (p *Package) renderTemplateMeta(rev *Revision, dstPath string) error {
+	data := map[string]any{
 		"name":    p.Name,
-		"commit":  src.Git.CurrentHash,
-		"rev":     src.Git.CurrentRevision,
+		"commit":  rev.Commit,
+		"rev":     string(rev.Ref),
 		"srcPath": p.SrcPath,
 		"dstPath": dstPath,
+		"spec":    maps.Clone(p.Metadata.mergedSpec),
 	}
+	spec := maps.Clone(p.Metadata.mergedSpec)
 	pCtx := template.New("tpl").Option("missingkey=error").Funcs(sprig.TxtFuncMap())
 	for k, v := range p.Metadata.mergedTemplated {
 		var tp bytes.Buffer
@@ -254,8 +361,9 @@ func (p *Package) renderTemplateMeta(src *PackageSource, dstPath string) error {
 		if err != nil {
 			return err
 		}
-		p.Metadata.mergedSpec[k] = tp.String()
+		spec[k] = tp.String()
 	}
+	p.Metadata.mergedSpec = spec
 	return nil
 }
 
@@ -265,6 +373,10 @@ func ParseFleetSpec(object []byte) (*Fleet, error) {
 		return nil, err
 	}
 
+	if err := fleet.ExpandGenerators(); err != nil {
+		return nil, err
+	}
+
 	// Defaults for defaults
 	if fleet.Spec.Defaults.Enabled == nil {
 		fleet.Spec.Defaults.Enabled = PtrTo(true)
@@ -284,39 +396,85 @@ func ParseFleetSpec(object []byte) (*Fleet, error) {
 	return fleet, nil
 }
 
-func NewPackageSource(u *Upstream, fileBase, username, password string) (*PackageSource, fn.Results, error) {
+// ResolveLocalUpstreams resolves directories of local upstreams
+// relative to the directory of the Fleet resource
+func (fleet *Fleet) ResolveLocalUpstreams(fleetDir string) {
+	for idx := range fleet.Spec.Upstreams {
+		u := &fleet.Spec.Upstreams[idx]
+		if u.Type == api.PackageUpstreamTypeLocal {
+			u.Local.path = filepath.Join(fleetDir, u.Local.Directory)
+		}
+	}
+}
+
+// NewPackageSource creates a source for an upstream. Git upstreams use
+// a mirror in cacheDir, which is created or updated
+func NewPackageSource(u *Upstream, fileBase, cacheDir, username, password, knownHosts string) (*PackageSource, fn.Results, error) {
 	var fnResults fn.Results
 	if u.Type == api.PackageUpstreamTypeGit {
 		// Hash repo url and auth method to create local tmp path
 		repoHash := base64.StdEncoding.EncodeToString([]byte(u.Git.Repo + "+" + u.Git.AuthMethod))
 		localPath := filepath.Join(fileBase, repoHash)
 		start := time.Now()
-		r, err := git.Clone(u.Git.Repo, u.Git.AuthMethod, username, password, localPath)
+		// Trees are read from the mirror into a sub-directory of localPath per commit
+		r, err := git.Mirror(u.Git.Repo, u.Git.AuthMethod, username, password, knownHosts, cacheDir)
 		if err != nil {
 			return nil, fnResults, err
 		}
 		t := time.Now()
 		elapsed := t.Sub(start).Truncate(time.Millisecond)
-		fnResults = append(fnResults, fn.GeneralResult(fmt.Sprintf("cloned %v in %v\n", u.Git.Repo, elapsed), fn.Info))
+		fnResults = append(fnResults, fn.GeneralResult(fmt.Sprintf("updated mirror of %v in %v\n", u.Git.Repo, elapsed), fn.Info))
 		return &PackageSource{
 			Type:     api.PackageUpstreamTypeGit,
 			Upstream: &u.Git,
 			Git:      r,
 			Username: username,
 			Password: password,
-			Path:     localPath,
+			base:     localPath,
+			fetches:  map[string]*fetch{},
 			refs:     []SourceRef{}}, fnResults, nil
 	}
-	return nil, fnResults, nil
+	// OCI and Helm chart sources are fetched per ref
+	src := &PackageSource{
+		Type:     u.Type,
+		Username: username,
+		Password: password,
+		base:     filepath.Join(fileBase, base64.URLEncoding.EncodeToString([]byte(u.Type+"+"+u.key()))),
+		fetches:  map[string]*fetch{},
+		refs:     []SourceRef{}}
+	switch u.Type {
+	case api.PackageUpstreamTypeOCI:
+		src.OCI = &u.OCI
+	case api.PackageUpstreamTypeHelmChart:
+		src.HelmChart = &u.HelmChart
+	default:
+		return nil, fnResults, fmt.Errorf("unsupported upstream type: %v", u.Type)
+	}
+	return src, fnResults, nil
 }
 
-func PackageSourceLookup(sources []PackageSource, upstream *Upstream) *PackageSource {
-	for idx := range sources {
-		src := &sources[idx]
-		if upstream.Type == api.PackageUpstreamTypeGit {
+func PackageSourceLookup(sources []*PackageSource, upstream *Upstream) *PackageSource {
+	for _, src := range sources {
+		if upstream.Type != src.Type {
+			continue
+		}
+		switch upstream.Type {
+		case api.PackageUpstreamTypeGit:
 			if upstream.Git == *src.Upstream {
 				return src
 			}
+		case api.PackageUpstreamTypeOCI:
+			if upstream.OCI == *src.OCI {
+				return src
+			}
+		case api.PackageUpstreamTypeHelmChart:
+			if upstream.HelmChart == *src.HelmChart {
+				return src
+			}
+		case api.PackageUpstreamTypeLocal:
+			if upstream.Local == *src.Local {
+				return src
+			}
 		}
 	}
 	return nil
@@ -333,29 +491,9 @@ func UpstreamLookup(fleet *Fleet, upstream UpstreamID) *Upstream {
 	return nil
 }
 
-func SourceEnsureVersion(src *PackageSource, ref SourceRef) (fn.Results, error) {
-	var fnResults fn.Results
-	if src.CurrRef == ref {
-		return fnResults, nil
-	}
-	if src.Type == api.PackageUpstreamTypeGit {
-		start := time.Now()
-		hash, err := src.Git.Checkout(string(ref))
-		if err != nil {
-			fnResults = append(fnResults, fn.GeneralResult(fmt.Sprintf("error fetching %v@%v\n", src.Upstream.Repo, ref), fn.Error))
-			return fnResults, err
-		}
-		t := time.Now()
-		elapsed := t.Sub(start).Truncate(time.Millisecond)
-		fnResults = append(fnResults, fn.GeneralResult(fmt.Sprintf("fetched %v@%v (%v) in %v\n", src.Upstream.Repo, ref, hash, elapsed), fn.Info))
-		src.CurrRef = ref
-		return fnResults, nil
-	}
-	return fnResults, nil
-}
-
-// TossFiles copies package files
-func (fleet *Fleet) TossFiles(sources []PackageSource, packages PackageSlice, dstBaseDir, pkgsBasePath string) (fn.Results, error) {
+// TossFiles copies package files. Packages are produced concurrently,
+// except that nested packages are produced after their parent packages
+func (fleet *Fleet) TossFiles(sources []*PackageSource, packages PackageSlice, dstBaseDir, pkgsBasePath string) (fn.Results, error) {
 	var fnResults fn.Results
 
 	outPackages := fleet.CollectOutputPackages(packages, pkgsBasePath)
@@ -372,45 +510,227 @@ func (fleet *Fleet) TossFiles(sources []PackageSource, packages PackageSlice, ds
 		}
 	}
 
-	// Sort packages against repo and repo ref to optimize git operations
+	// Sort packages against repo and repo ref for a stable ordering of results
 	sort.Sort(outPackages)
 
+	workDir, err := os.MkdirTemp("", "package-compositor-merge")
+	if err != nil {
+		return fnResults, err
+	}
+	defer os.RemoveAll(workDir)
+	local := collectLocalPackages(fleet.existing, outPackages)
+
+	pkgResults := make([]fn.Results, len(outPackages))
+	pkgErrs := make([]error, len(outPackages))
+	for _, level := range nestingLevels(outPackages) {
+		forEach(fleet.concurrency, len(level), func(n int) {
+			idx := level[n]
+			p := &outPackages[idx]
+			// Separate merge directories, since nested package paths overlap
+			pkgWorkDir := filepath.Join(workDir, strconv.Itoa(idx))
+			pkgResults[idx], pkgErrs[idx] = fleet.tossPackage(sources, p, local[p.dstAbsPath], dstBaseDir, pkgsBasePath, pkgWorkDir)
+		})
+	}
 	for idx := range outPackages {
-		p := &outPackages[idx]
+		fnResults = append(fnResults, pkgResults[idx]...)
+		if pkgErrs[idx] != nil {
+			return fnResults, pkgErrs[idx]
+		}
+		fleet.merged = append(fleet.merged, local[outPackages[idx].dstAbsPath]...)
+	}
+	return fnResults, nil
+}
 
-		d := filepath.Join(dstBaseDir, p.dstAbsPath)
-		u := UpstreamLookup(fleet, p.Upstream)
-		if u == nil {
-			return fnResults, fmt.Errorf("unknown upstream: %v", p.Upstream)
+// nestingLevels groups the indices of packages by the number of
+// parent packages, such that parents are produced before nested packages
+func nestingLevels(packages PackageSlice) [][]int {
+	var levels [][]int
+	for idx := range packages {
+		depth := 0
+		for pidx := range packages {
+			if strings.HasPrefix(packages[idx].dstAbsPath, packages[pidx].dstAbsPath+"/") {
+				depth++
+			}
 		}
-		src := PackageSourceLookup(sources, u)
-		if src == nil {
-			return fnResults, fmt.Errorf("unknown upstream source: %v", p.Upstream)
+		for len(levels) <= depth {
+			levels = append(levels, nil)
 		}
-		fnRes, err := SourceEnsureVersion(src, p.Ref)
+		levels[depth] = append(levels[depth], idx)
+	}
+	return levels
+}
+
+// tossPackage copies the files of a package to the destination, merged
+// with the existing package given by items if any, and updates the
+// package metadata
+func (fleet *Fleet) tossPackage(sources []*PackageSource, p *Package, items fn.KubeObjects, dstBaseDir, pkgsBasePath, workDir string) (fn.Results, error) {
+	var fnResults fn.Results
+	d := filepath.Join(dstBaseDir, p.dstAbsPath)
+	u := UpstreamLookup(fleet, p.Upstream)
+	if u == nil {
+		return fnResults, fmt.Errorf("unknown upstream: %v", p.Upstream)
+	}
+	src := PackageSourceLookup(sources, u)
+	if src == nil {
+		return fnResults, fmt.Errorf("unknown upstream source: %v", p.Upstream)
+	}
+	pkgPath, err := filepath.Rel(pkgsBasePath, p.dstAbsPath)
+	if err != nil {
+		return fnResults, err
+	}
+	if len(items) > 0 {
+		// Existing packages are merged with the previous upstream, i.e. as given by the lock
+		fnRes, err := fleet.collectOriginal(sources, p, pkgPath, filepath.Join(workDir, "original"))
 		fnResults = append(fnResults, fnRes...)
 		if err != nil {
 			return fnResults, err
 		}
-		util.ResultPrintf(&fnResults, fn.Info, "package %v; %v --> %v", p.Name, p.SrcPath, p.dstRelPath)
-		s := filepath.Join(src.Path, p.SrcPath)
-		err = os.CopyFS(d, os.DirFS(s))
+	}
+	rev, fnRes, err := fleet.packageRevision(src, p, pkgPath)
+	fnResults = append(fnResults, fnRes...)
+	if err != nil {
+		return fnResults, err
+	}
+	util.ResultPrintf(&fnResults, fn.Info, "package %v; %v --> %v", p.Name, p.SrcPath, p.dstRelPath)
+	s := src.packageDir(rev, p.SrcPath)
+	if len(items) > 0 {
+		s, err = mergeWithLocal(s, p, pkgPath, items, workDir, &fnResults)
 		if err != nil {
-			return fnResults, fmt.Errorf("copying package %v dir (%v --> %v): %v", p.Name, p.SrcPath, p.dstRelPath, err)
+			return fnResults, fmt.Errorf("merging package %v: %v", p.Name, err)
 		}
-		// TODO: assumes git upstream
-		err = p.renderTemplateMeta(src, p.dstAbsPath)
+	}
+	err = os.CopyFS(d, os.DirFS(s))
+	if err != nil {
+		return fnResults, fmt.Errorf("copying package %v dir (%v --> %v): %v", p.Name, p.SrcPath, p.dstRelPath, err)
+	}
+	err = p.renderTemplateMeta(rev, p.dstAbsPath)
+	if err != nil {
+		return fnResults, fmt.Errorf("rendering package %v metadata: %v", p.Name, err)
+	}
+	err = kpt.UpdateKptMetadata(d, p.Name, p.Metadata.mergedSpec, src.upstream(rev, p))
+	if err != nil {
+		return fnResults, fmt.Errorf("mutating package %v metadata: %v", p.Name, err)
+	}
+	err = p.writePipeline(d)
+	if err != nil {
+		return fnResults, fmt.Errorf("mutating package %v pipeline: %v", p.Name, err)
+	}
+	return fnResults, nil
+}
+
+// packageRevision fetches the source of a package at the locked
+// commit or by resolving the package ref. The resulting commit is
+// recorded in the new lock
+func (fleet *Fleet) packageRevision(src *PackageSource, p *Package, pkgPath string) (*Revision, fn.Results, error) {
+	var fnResults fn.Results
+	var prev *PackageLock
+	if fleet.lock != nil {
+		prev = fleet.lock.lookup(pkgPath, p.Upstream, p.Ref)
+	}
+	ref, locked := p.Ref, ""
+	if prev != nil && fleet.lockMode != LockModeUpdate {
+		locked = prev.Commit
+		if prev.Tag != "" {
+			ref = SourceRef(prev.Tag)
+		}
+	} else {
+		var err error
+		ref, err = src.resolveRef(p.Ref)
 		if err != nil {
-			return fnResults, fmt.Errorf("rendering package %v metadata: %v", p.Name, err)
+			return nil, fnResults, err
 		}
-		err = kpt.UpdateKptMetadata(d, p.Name, p.Metadata.mergedSpec, p.SrcPath, src.Git.URI, src.Git.CurrentRevision, src.Git.CurrentHash)
-		if err != nil {
-			return fnResults, fmt.Errorf("mutating package %v metadata: %v", p.Name, err)
+		if ref != p.Ref {
+			util.ResultPrintf(&fnResults, fn.Info, "package %v; resolved %v to %v", pkgPath, p.Ref, ref)
+		}
+	}
+	rev, fnRes, err := src.Fetch(ref, locked)
+	fnResults = append(fnResults, fnRes...)
+	if err != nil {
+		return nil, fnResults, err
+	}
+	if rev.Commit != "" {
+		if prev != nil && prev.Commit != rev.Commit {
+			util.ResultPrintf(&fnResults, fn.Info, "package %v moved; %v@%v: %v --> %v", pkgPath, p.Upstream, p.Ref, prev.Commit, rev.Commit)
+		}
+		pl := PackageLock{Package: pkgPath, Upstream: p.Upstream, Ref: p.Ref, Commit: rev.Commit, SourcePath: p.SrcPath}
+		if ref != p.Ref {
+			pl.Tag = string(ref)
 		}
+		fleet.mu.Lock()
+		fleet.newLock.set(pl)
+		fleet.mu.Unlock()
+	}
+	return rev, fnResults, nil
+}
+
+// collectOriginal copies the previous upstream version of an existing
+// package to originalBase. Packages without a lock use an empty
+// original, i.e. upstream values take precedence
+func (fleet *Fleet) collectOriginal(sources []*PackageSource, p *Package, pkgPath, originalBase string) (fn.Results, error) {
+	var fnResults fn.Results
+	if fleet.lock == nil {
+		return fnResults, nil
+	}
+	prev := fleet.lock.entry(pkgPath)
+	if prev == nil {
+		return fnResults, nil
+	}
+	u := UpstreamLookup(fleet, prev.Upstream)
+	var src *PackageSource
+	if u != nil {
+		src = PackageSourceLookup(sources, u)
+	}
+	if src == nil {
+		util.ResultPrintf(&fnResults, fn.Info, "package %v; previous upstream %v not found, merging without original", pkgPath, prev.Upstream)
+		return fnResults, nil
+	}
+	// Locks without source path predate recording it
+	srcPath := prev.SourcePath
+	if srcPath == "" {
+		srcPath = p.SrcPath
+	}
+	ref := prev.Ref
+	if prev.Tag != "" {
+		ref = SourceRef(prev.Tag)
+	}
+	rev, fnRes, err := src.Fetch(ref, prev.Commit)
+	fnResults = append(fnResults, fnRes...)
+	if err != nil {
+		return fnResults, err
+	}
+	err = os.CopyFS(filepath.Join(originalBase, pkgPath), os.DirFS(src.packageDir(rev, srcPath)))
+	if err != nil {
+		return fnResults, fmt.Errorf("copying original package %v: %v", p.Name, err)
 	}
 	return fnResults, nil
 }
 
+// mergeWithLocal merges the updated upstream version of a package in
+// upstreamDir with the original upstream and local package and returns
+// the directory holding the result. Conflicts are reported as warnings
+func mergeWithLocal(upstreamDir string, p *Package, pkgPath string, items fn.KubeObjects, workDir string, fnResults *fn.Results) (string, error) {
+	originalDir := filepath.Join(workDir, "original", pkgPath)
+	updatedDir := filepath.Join(workDir, "updated", pkgPath)
+	localDir := filepath.Join(workDir, "local", pkgPath)
+	if err := os.MkdirAll(originalDir, 0o700); err != nil {
+		return "", err
+	}
+	if err := os.CopyFS(updatedDir, os.DirFS(upstreamDir)); err != nil {
+		return "", err
+	}
+	if err := writeLocalPackage(localDir, p.dstAbsPath, items); err != nil {
+		return "", err
+	}
+	conflicts, err := mergePackage(originalDir, updatedDir, localDir)
+	if err != nil {
+		return "", err
+	}
+	for _, c := range conflicts {
+		util.ResultPrintf(fnResults, fn.Warning, "package %v; conflict in %v, upstream values used for %v", pkgPath, c.Resource, strings.Join(c.Fields, ", "))
+	}
+	return localDir, nil
+}
+
 // CollectOutputPackages will precompute package paths and return a list of packages that should
 // be output, i.e. ignoring stubs and disabled packages
 func (fleet *Fleet) CollectOutputPackages(packages PackageSlice, pkgsBasePath string) PackageSlice {
@@ -431,7 +751,7 @@ func (fleet *Fleet) CollectOutputPackages(packages PackageSlice, pkgsBasePath st
 }
 
 // ComputeReferences loops through all packages and collect all references used by packages
-func (fleet *Fleet) ComputeReferences(sources []PackageSource, packages PackageSlice) {
+func (fleet *Fleet) ComputeReferences(sources []*PackageSource, packages PackageSlice) {
 	for idx := range packages {
 		p := &packages[idx]
 		u := UpstreamLookup(fleet, p.Upstream)
@@ -439,7 +759,7 @@ func (fleet *Fleet) ComputeReferences(sources []PackageSource, packages PackageS
 		if !slices.Contains(src.refs, p.Ref) {
 			src.refs = append(src.refs, p.Ref)
 		}
-		p.sortKey = u.Git.Repo + string(p.Ref)
+		p.sortKey = u.key() + string(p.Ref)
 	}
 }
 
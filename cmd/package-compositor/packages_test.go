@@ -14,9 +14,16 @@
 package main
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 
+	"github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
+	"github.com/krm-functions/catalog/pkg/kpt"
+	kptfile "github.com/nephio-project/porch/pkg/kpt/api/kptfile/v1"
 	a "github.com/stretchr/testify/assert"
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
 )
 
 var fleetMustParse = []string{`apiVersion: fn.kpt.dev/v1alpha1
@@ -77,6 +84,29 @@ spec:
         templated:
           k8: "{{.name}}"
           k9: "{{.name | sha256sum | trunc 2 }}"`,
+	`apiVersion: fn.kpt.dev/v1alpha1
+kind: Fleet
+metadata:
+  name: example-fleet
+spec:
+  upstreams:
+  - name: oci-packages
+    type: oci
+    oci:
+      image: ghcr.io/example/packages
+  - name: cert-manager
+    type: helmChart
+    helmChart:
+      repo: https://charts.jetstack.io
+      name: cert-manager
+  packages:
+  - name: foo
+    upstream: oci-packages
+    ref: v1.0
+    sourcePath: pkg1
+  - name: cert-manager
+    upstream: cert-manager
+    ref: v1.14.4`,
 }
 
 var fleetMustFailParse = []string{
@@ -115,6 +145,62 @@ spec:
   - name: foo
     sourcePath: examples/package-composer/pkg1
     ref: main
+`,
+	// Known hosts with HTTPS auth method
+	`apiVersion: fn.kpt.dev/v1alpha1
+kind: Fleet
+metadata:
+  name: example-fleet
+spec:
+  upstreams:
+  - name: example
+    type: git
+    git:
+      repo: https://github.com/krm-functions/catalog.git
+      authMethod: httpsToken
+      auth:
+        kind: Secret
+        name: token
+      knownHosts:
+        kind: ConfigMap
+        name: known-hosts
+  packages:
+  - name: foo
+    sourcePath: examples/package-composer/pkg1
+    ref: main
+`,
+	// Helm chart upstream without chart name
+	`apiVersion: fn.kpt.dev/v1alpha1
+kind: Fleet
+metadata:
+  name: example-fleet
+spec:
+  upstreams:
+  - name: example
+    type: helmChart
+    helmChart:
+      repo: https://charts.jetstack.io
+  packages:
+  - name: foo
+    ref: v1.14.4
+`,
+	// Generated package names not unique
+	`apiVersion: fn.kpt.dev/v1alpha1
+kind: Fleet
+metadata:
+  name: example-fleet
+spec:
+  upstreams:
+  - name: example
+    type: git
+    git:
+      repo: https://github.com/krm-functions/catalog.git
+  generators:
+  - matrix:
+      cluster: [a, b]
+    template:
+      name: foo
+      ref: main
 `,
 	// Undefined upstream
 	`apiVersion: fn.kpt.dev/v1alpha1
@@ -164,3 +250,312 @@ func TestMetadataPropagation(t *testing.T) {
 	a.Equal(t, map[string]string{"name": "zap2", "k7": "v7"}, f.Spec.Packages[2].Packages[1].Metadata.mergedSpec, "calculated metadata")
 	a.Equal(t, map[string]string{"k8": "{{.name}}", "k9": "{{.name | sha256sum | trunc 2 }}"}, f.Spec.Packages[2].Packages[1].Metadata.mergedTemplated, "calculated metadata")
 }
+
+func TestPackageGenerators(t *testing.T) {
+	f, err := ParseFleetSpec([]byte(`apiVersion: fn.kpt.dev/v1alpha1
+kind: Fleet
+metadata:
+  name: example-fleet
+spec:
+  upstreams:
+  - name: example
+    type: git
+    git:
+      repo: https://github.com/krm-functions/catalog.git
+  defaults:
+    ref: main
+  packages:
+  - name: foo
+  generators:
+  - matrix:
+      region: [eu, us]
+      cluster: [a, b]
+    template:
+      name: "app-{{.cluster}}-{{.region}}"
+      sourcePath: app
+      metadata:
+        spec:
+          tier: prod
+        templated:
+          fqdn: "{{.spec.cluster}}.{{.spec.region}}.{{.spec.tier}}"
+  - list:
+    - site: x
+    - site: "y"
+    template:
+      name: "edge-{{.site}}"
+      sourcePath: "edge/{{.site}}"`))
+	if f == nil || err != nil {
+		t.Fatalf(`Expected Fleet spec to parse: %v`, err)
+	}
+	var names []string
+	for idx := range f.Spec.Packages {
+		names = append(names, f.Spec.Packages[idx].Name)
+	}
+	a.Equal(t, []string{"foo", "app-a-eu", "app-a-us", "app-b-eu", "app-b-us", "edge-x", "edge-y"}, names)
+	p := &f.Spec.Packages[2]
+	a.Equal(t, "app", p.SrcPath)
+	a.Equal(t, SourceRef("main"), p.Ref)
+	a.Equal(t, map[string]string{"name": "app-a-us", "cluster": "a", "region": "us", "tier": "prod"}, p.Metadata.mergedSpec)
+	err = p.renderTemplateMeta(&Revision{Ref: "main"}, "fleet/app-a-us")
+	a.NoError(t, err)
+	a.Equal(t, "a.us.prod", p.Metadata.mergedSpec["fqdn"])
+	a.Equal(t, "edge/y", f.Spec.Packages[6].SrcPath)
+
+	// Matrix parameters without values would silently generate no packages
+	g := &PackageGenerator{Matrix: map[string][]string{"region": {"eu"}, "cluster": {}}}
+	_, err = g.parameters()
+	a.EqualError(t, err, `matrix parameter "cluster" has no values`)
+}
+
+func TestDuplicatePackageNames(t *testing.T) {
+	fleet := `apiVersion: fn.kpt.dev/v1alpha1
+kind: Fleet
+metadata:
+  name: example-fleet
+spec:
+  upstreams:
+  - name: example
+    type: git
+    git:
+      repo: https://github.com/krm-functions/catalog.git
+  defaults:
+    ref: main
+`
+	for _, packages := range []string{
+		`  packages:
+  - name: foo
+  - name: foo
+`,
+		`  packages:
+  - name: foo
+    stub: true
+    packages:
+    - name: bar
+    - name: bar
+`,
+		`  packages:
+  - name: edge-x
+  generators:
+  - list:
+    - site: x
+    template:
+      name: "edge-{{.site}}"
+      sourcePath: edge
+`,
+	} {
+		_, err := ParseFleetSpec([]byte(fleet + packages))
+		a.ErrorContains(t, err, "duplicate package name", packages)
+	}
+	// Names need only be unique among sibling packages
+	_, err := ParseFleetSpec([]byte(fleet + `  packages:
+  - name: foo
+    packages:
+    - name: foo
+`))
+	a.NoError(t, err)
+}
+
+func TestLookupKnownHosts(t *testing.T) {
+	objs, err := fn.ParseKubeObjects([]byte(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: known-hosts
+data:
+  known_hosts: gitlab.example.com ssh-ed25519 AAAA
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: known-hosts
+  namespace: ci
+data:
+  known_hosts: Z2l0bGFiLmV4YW1wbGUuY29tIHNzaC1lZDI1NTE5IEFBQUE=
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := &fn.ResourceList{Items: objs}
+	kh, err := LookupKnownHosts(&Auth{Kind: "ConfigMap", Name: "known-hosts"}, rl)
+	a.NoError(t, err)
+	a.Equal(t, "gitlab.example.com ssh-ed25519 AAAA", kh)
+	kh, err = LookupKnownHosts(&Auth{Kind: "Secret", Name: "known-hosts", Namespace: "ci"}, rl)
+	a.NoError(t, err)
+	a.Equal(t, "gitlab.example.com ssh-ed25519 AAAA", kh)
+	_, err = LookupKnownHosts(&Auth{Kind: "Secret", Name: "known-hosts"}, rl)
+	a.Error(t, err)
+}
+
+func TestLocalUpstream(t *testing.T) {
+	nodes, err := FilesystemToObjects("../../examples/package-compositor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fleet, err := fn.ParseKubeObject([]byte(`apiVersion: fn.kpt.dev/v1alpha1
+kind: Fleet
+metadata:
+  name: example-fleet
+  annotations:
+    config.kubernetes.io/path: specs/local/packages.yaml
+    internal.config.kubernetes.io/path: specs/local/packages.yaml
+spec:
+  upstreams:
+  - name: local
+    type: local
+    local:
+      directory: ../..
+  packages:
+  - name: foo
+    sourcePath: pkg1
+    metadata:
+      templated:
+        source: "{{.srcPath}}"
+    packages:
+    - name: bar
+      sourcePath: pkg2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := &fn.ResourceList{Items: fn.KubeObjects{fleet}}
+	for _, nn := range nodes {
+		if nn.GetKind() == "Fleet" { // Example fleets use git upstreams
+			continue
+		}
+		if err = rl.UpsertObjectToItems(nn, func(_, _ *fn.KubeObject) bool { return false }, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("LOCAL_PACKAGES_DIR", t.TempDir())
+	ok, err := Run(rl)
+	if !ok || err != nil {
+		t.Fatalf("Expected Run to succeed: %v", err)
+	}
+
+	outputs := map[string]*fn.KubeObject{}
+	for _, o := range rl.Items {
+		outputs[o.GetAnnotation(kioutil.PathAnnotation)] = o
+	}
+	a.Contains(t, outputs, "specs/local/example-fleet/foo/configmap1.yaml")
+	a.Contains(t, outputs, "specs/local/example-fleet/foo/bar/configmap2.yaml")
+	kf := outputs["specs/local/example-fleet/foo/Kptfile"]
+	if kf == nil {
+		t.Fatal("Kptfile of package 'foo' not found")
+	}
+	a.Equal(t, "foo", kf.GetName())
+	a.Equal(t, "pkg1", kf.GetAnnotation(kpt.UpstreamDirectoryAnnotation))
+	a.Equal(t, "local", kf.GetAnnotation(kpt.UpstreamTypeAnnotation))
+	_, found, _ := kf.NestedString("upstream", "type")
+	a.False(t, found)
+	// kpt rejects unknown Kptfile fields
+	dec := yaml.NewDecoder(strings.NewReader(kf.String()))
+	dec.KnownFields(true)
+	a.NoError(t, dec.Decode(&kptfile.KptFile{}))
+	ctx := outputs["specs/local/example-fleet/foo/package-context.yaml"]
+	if ctx == nil {
+		t.Fatal("package-context.yaml of package 'foo' not found")
+	}
+	source, _, _ := ctx.NestedString("data", "source")
+	a.Equal(t, "pkg1", source)
+}
+
+func TestNestedPackages(t *testing.T) {
+	var input, local strings.Builder
+	input.WriteString(`apiVersion: fn.kpt.dev/v1alpha1
+kind: Fleet
+metadata:
+  name: example-fleet
+  annotations:
+    internal.config.kubernetes.io/path: fleet.yaml
+spec:
+  upstreams:
+  - name: local
+    type: local
+    local:
+      directory: upstream
+  packages:
+`)
+	// Nested packages with existing local packages, i.e. they are
+	// merged in overlapping directories
+	for _, parent := range []string{"a", "b", "c", "d"} {
+		fmt.Fprintf(&input, `  - name: %[1]v
+    sourcePath: parent
+    metadata:
+      inheritFromParent: false
+      spec:
+        team: %[1]v
+      templated:
+        owner: "{{.spec.team}}-{{.name}}"
+    packages:
+    - name: child
+      sourcePath: child
+      metadata:
+        templated:
+          owner: "{{.spec.team}}-{{.name}}"
+      packages:
+      - name: grandchild
+        sourcePath: child
+`, parent)
+		for _, pkg := range []string{parent, parent + "/child", parent + "/child/grandchild"} {
+			fmt.Fprintf(&local, `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: cm
+  annotations:
+    internal.config.kubernetes.io/path: example-fleet/%v/cm.yaml
+data:
+  local: %v
+`, pkg, pkg)
+		}
+	}
+	input.WriteString(local.String())
+	for _, src := range []string{"parent", "child"} {
+		fmt.Fprintf(&input, `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: cm
+  annotations:
+    internal.config.kubernetes.io/path: upstream/%v/cm.yaml
+data:
+  upstream: %v
+`, src, src)
+	}
+
+	objs, err := fn.ParseKubeObjects([]byte(input.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := &fn.ResourceList{Items: objs}
+	t.Setenv("LOCAL_PACKAGES_DIR", t.TempDir())
+	ok, err := Run(rl)
+	if !ok || err != nil {
+		t.Fatalf("Expected Run to succeed: %v", err)
+	}
+
+	outputs := map[string]*fn.KubeObject{}
+	for _, o := range rl.Items {
+		outputs[o.GetAnnotation(kioutil.PathAnnotation)] = o
+	}
+	for _, parent := range []string{"a", "b", "c", "d"} {
+		for pkg, src := range map[string]string{parent: "parent", parent + "/child": "child", parent + "/child/grandchild": "child"} {
+			cm := outputs["example-fleet/"+pkg+"/cm.yaml"]
+			if cm == nil {
+				t.Fatalf("ConfigMap of package %v not found", pkg)
+			}
+			data, _, _ := cm.NestedStringMap("data")
+			a.Equal(t, map[string]string{"local": pkg, "upstream": src}, data, pkg)
+		}
+		ctx := outputs["example-fleet/"+parent+"/child/package-context.yaml"]
+		if ctx == nil {
+			t.Fatalf("package-context.yaml of package %v/child not found", parent)
+		}
+		owner, _, _ := ctx.NestedString("data", "owner")
+		a.Equal(t, parent+"-child", owner)
+	}
+}
+
+func TestNestingLevels(t *testing.T) {
+	packages := PackageSlice{{dstAbsPath: "fleet/a/b"}, {dstAbsPath: "fleet/a"}, {dstAbsPath: "fleet/ab"}, {dstAbsPath: "fleet/a/b/c"}}
+	a.Equal(t, [][]int{{1, 2}, {0}, {3}}, nestingLevels(packages))
+}
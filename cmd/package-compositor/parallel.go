@@ -0,0 +1,60 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
+)
+
+// Number of concurrent upstream fetches and package operations
+const defaultConcurrency = 4
+
+func concurrency(fnConfig *fn.KubeObject) (int, error) {
+	n := defaultConcurrency
+	if fnConfig != nil {
+		if val, found, err := fnConfig.NestedString("data", "concurrency"); err == nil && found {
+			n, err = strconv.Atoi(val)
+			if err != nil {
+				return 0, fmt.Errorf("invalid concurrency %q: %w", val, err)
+			}
+		}
+	}
+	if n < 1 {
+		return 0, fmt.Errorf("concurrency must be positive, got %v", n)
+	}
+	return n, nil
+}
+
+// forEach calls f concurrently for indices 0 to n-1, with at most
+// limit calls in progress
+func forEach(limit, n int, f func(idx int)) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(limit, 1))
+	for idx := range n {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(idx int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			f(idx)
+		}(idx)
+	}
+	wg.Wait()
+}
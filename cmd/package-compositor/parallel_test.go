@@ -0,0 +1,59 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
+	a "github.com/stretchr/testify/assert"
+)
+
+func TestConcurrency(t *testing.T) {
+	n, err := concurrency(nil)
+	a.NoError(t, err)
+	a.Equal(t, defaultConcurrency, n)
+	for val, expected := range map[string]int{"8": 8, "1": 1, "0": 0, "x": 0} {
+		cfg := fn.NewEmptyKubeObject()
+		_ = cfg.SetNestedString(val, "data", "concurrency")
+		n, err = concurrency(cfg)
+		if expected == 0 {
+			a.Error(t, err, val)
+			continue
+		}
+		a.NoError(t, err, val)
+		a.Equal(t, expected, n, val)
+	}
+}
+
+func TestForEach(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	called := make([]bool, 10)
+	forEach(3, len(called), func(idx int) {
+		mu.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		called[idx] = true
+		mu.Unlock()
+	})
+	a.LessOrEqual(t, maxInFlight, 3)
+	a.NotContains(t, called, false)
+}
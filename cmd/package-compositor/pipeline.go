@@ -0,0 +1,198 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/krm-functions/catalog/pkg/kpt"
+	kptfile "github.com/nephio-project/porch/pkg/kpt/api/kptfile/v1"
+	"sigs.k8s.io/kustomize/kyaml/kio/filters"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	PipelinePositionAppend  = "append"
+	PipelinePositionPrepend = "prepend"
+
+	applySettersAPIVersion = "experimental.fn.kpt.dev/v1alpha1"
+	applySettersKind       = "ApplySetters"
+	// Name of the generated ApplySetters resource and pipeline function
+	packageSettersName = "package-setters"
+)
+
+// PackagePipeline are functions added to the Kptfile pipeline of a package
+type PackagePipeline struct {
+	Mutators   []PipelineFunction `yaml:"mutators,omitempty" json:"mutators,omitempty"`
+	Validators []PipelineFunction `yaml:"validators,omitempty" json:"validators,omitempty"`
+}
+
+// PipelineFunction is a function added to the Kptfile pipeline. Functions
+// are appended to the upstream pipeline unless 'position' is 'prepend'
+type PipelineFunction struct {
+	Image string `yaml:"image,omitempty" json:"image,omitempty"`
+	// Defaults to the image name. Existing functions with the same name are replaced
+	Name      string            `yaml:"name,omitempty" json:"name,omitempty"`
+	ConfigMap map[string]string `yaml:"configMap,omitempty" json:"configMap,omitempty"`
+	// Inline function config resource, written to a file in the package
+	Config   map[string]any `yaml:"config,omitempty" json:"config,omitempty"`
+	Position string         `yaml:"position,omitempty" json:"position,omitempty"`
+}
+
+// PackageSetters generates an ApplySetters resource from the package
+// 'metadata.spec' and prepends an apply-setters function using it to
+// the Kptfile pipeline
+type PackageSetters struct {
+	// The apply-setters function image
+	Image string `yaml:"image,omitempty" json:"image,omitempty"`
+}
+
+func (pl *PackagePipeline) Validate() error {
+	for _, fns := range [][]PipelineFunction{pl.Mutators, pl.Validators} {
+		names := map[string]bool{}
+		for idx := range fns {
+			f := &fns[idx]
+			if f.Image == "" {
+				return fmt.Errorf("pipeline functions require 'image'")
+			}
+			if len(f.ConfigMap) > 0 && len(f.Config) > 0 {
+				return fmt.Errorf("pipeline function %v cannot have both 'configMap' and 'config'", f.name())
+			}
+			if f.Position != "" && f.Position != PipelinePositionAppend && f.Position != PipelinePositionPrepend {
+				return fmt.Errorf("pipeline function %v, invalid position %q", f.name(), f.Position)
+			}
+			if names[f.name()] {
+				return fmt.Errorf("pipeline function names must be unique, duplicate %q", f.name())
+			}
+			names[f.name()] = true
+		}
+	}
+	return nil
+}
+
+// name returns the function name, defaulting to the image name without
+// registry and tag or digest
+func (f *PipelineFunction) name() string {
+	if f.Name != "" {
+		return f.Name
+	}
+	image, _, _ := strings.Cut(f.Image, "@")
+	image = path.Base(image)
+	image, _, _ = strings.Cut(image, ":")
+	return image
+}
+
+// configFile returns the file name of an inline function config
+func (f *PipelineFunction) configFile() string {
+	return "fn-config-" + f.name() + ".yaml"
+}
+
+// writePipeline adds the pipeline functions and setters of a package
+// to the Kptfile in dir. Inline function configs and the ApplySetters
+// resource are written to files in dir
+func (p *Package) writePipeline(dir string) error {
+	prepend, appendFns := &kptfile.Pipeline{}, &kptfile.Pipeline{}
+	if p.Setters != nil {
+		if err := writeSetters(dir, p.Metadata.mergedSpec); err != nil {
+			return err
+		}
+		prepend.Mutators = append(prepend.Mutators, kptfile.Function{
+			Image:      p.Setters.Image,
+			Name:       packageSettersName,
+			ConfigPath: packageSettersName + ".yaml",
+		})
+	}
+	if p.Pipeline != nil {
+		for _, l := range []struct {
+			fns              []PipelineFunction
+			prepend, appends *[]kptfile.Function
+		}{
+			{p.Pipeline.Mutators, &prepend.Mutators, &appendFns.Mutators},
+			{p.Pipeline.Validators, &prepend.Validators, &appendFns.Validators},
+		} {
+			for idx := range l.fns {
+				kf, err := l.fns[idx].kptfileFunction(dir)
+				if err != nil {
+					return err
+				}
+				if l.fns[idx].Position == PipelinePositionPrepend {
+					*l.prepend = append(*l.prepend, *kf)
+				} else {
+					*l.appends = append(*l.appends, *kf)
+				}
+			}
+		}
+	}
+	if len(prepend.Mutators)+len(prepend.Validators)+len(appendFns.Mutators)+len(appendFns.Validators) == 0 {
+		return nil
+	}
+	return kpt.AddPipelineFunctions(dir, prepend, appendFns)
+}
+
+// kptfileFunction returns the Kptfile function declaration. Inline
+// configs are written to a file in dir
+func (f *PipelineFunction) kptfileFunction(dir string) (*kptfile.Function, error) {
+	kf := &kptfile.Function{
+		Image:     f.Image,
+		Name:      f.name(),
+		ConfigMap: f.ConfigMap,
+	}
+	if len(f.Config) == 0 {
+		return kf, nil
+	}
+	node, err := yaml.FromMap(f.Config)
+	if err != nil {
+		return nil, fmt.Errorf("pipeline function %v config: %w", f.name(), err)
+	}
+	if node.GetApiVersion() == "" || node.GetKind() == "" {
+		return nil, fmt.Errorf("pipeline function %v config requires 'apiVersion' and 'kind'", f.name())
+	}
+	if node.GetName() == "" {
+		if err = node.SetName(f.name()); err != nil {
+			return nil, err
+		}
+	}
+	kf.ConfigPath = f.configFile()
+	return kf, writeLocalConfig(filepath.Join(dir, kf.ConfigPath), node)
+}
+
+// writeSetters writes an ApplySetters resource with setters from spec
+func writeSetters(dir string, spec map[string]string) error {
+	node, err := yaml.FromMap(map[string]any{
+		"apiVersion": applySettersAPIVersion,
+		"kind":       applySettersKind,
+		"metadata":   map[string]any{"name": packageSettersName},
+		"setters":    map[string]any{"data": spec},
+	})
+	if err != nil {
+		return err
+	}
+	return writeLocalConfig(filepath.Join(dir, packageSettersName+".yaml"), node)
+}
+
+// writeLocalConfig writes a resource marked as local config to filename
+func writeLocalConfig(filename string, node *yaml.RNode) error {
+	if err := node.PipeE(yaml.SetAnnotation(filters.LocalConfigAnnotation, "true")); err != nil {
+		return err
+	}
+	s, err := node.String()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, []byte(s), 0o600)
+}
@@ -0,0 +1,115 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/krm-functions/catalog/pkg/kpt"
+	a "github.com/stretchr/testify/assert"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+func TestWritePipeline(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "Kptfile"), []byte(`apiVersion: kpt.dev/v1
+kind: Kptfile
+metadata:
+  name: foo
+pipeline:
+  mutators:
+  - image: ghcr.io/example/upstream-fn:v1
+    name: upstream-fn
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p Package
+	err = yaml.Unmarshal([]byte(`name: foo
+setters:
+  image: ghcr.io/krm-functions/apply-setters:v1
+pipeline:
+  mutators:
+  - image: ghcr.io/example/set-labels:v1
+    configMap:
+      app: foo
+    position: prepend
+  - image: ghcr.io/example/set-annotations@sha256:abc
+    config:
+      apiVersion: fn.kpt.dev/v1alpha1
+      kind: SetAnnotations
+      annotations:
+        owner: team
+  validators:
+  - image: ghcr.io/example/kubeconform:v1
+    name: schema
+`), &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.NoError(t, p.Pipeline.Validate())
+	p.Metadata.mergedSpec = map[string]string{"name": "foo", "replicas": "3", "enabled": "true"}
+
+	// Functions are replaced by name, i.e. writing twice is idempotent
+	for range 2 {
+		a.NoError(t, p.writePipeline(dir))
+	}
+	kf, err := yaml.ReadFile(filepath.Join(dir, "Kptfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := func(field string) []string {
+		var result []string
+		fns, _ := kf.Pipe(yaml.Lookup("pipeline", field))
+		elements, _ := fns.Elements()
+		for _, fn := range elements {
+			name, _ := fn.GetString("name")
+			result = append(result, name)
+		}
+		return result
+	}
+	a.Equal(t, []string{"package-setters", "set-labels", "upstream-fn", "set-annotations"}, names("mutators"))
+	a.Equal(t, []string{"schema"}, names("validators"))
+	configPath, _ := kf.GetString("pipeline.mutators.[name=set-annotations].configPath")
+	a.Equal(t, "fn-config-set-annotations.yaml", configPath)
+	_, err = kpt.ReadKptfile(filepath.Join(dir, "Kptfile"))
+	a.NoError(t, err)
+
+	setters, err := yaml.ReadFile(filepath.Join(dir, "package-setters.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Equal(t, "ApplySetters", setters.GetKind())
+	value, _ := setters.GetString("setters.data.enabled")
+	a.Equal(t, "true", value)
+	fnConfig, err := yaml.ReadFile(filepath.Join(dir, "fn-config-set-annotations.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Equal(t, "set-annotations", fnConfig.GetName())
+	a.Equal(t, "true", fnConfig.GetAnnotations()["config.kubernetes.io/local-config"])
+}
+
+func TestPipelineValidate(t *testing.T) {
+	for _, pl := range []PackagePipeline{
+		{Mutators: []PipelineFunction{{Name: "no-image"}}},
+		{Mutators: []PipelineFunction{{Image: "fn:v1", Position: "middle"}}},
+		{Mutators: []PipelineFunction{{Image: "fn:v1"}, {Image: "other/fn:v2"}}},
+		{Validators: []PipelineFunction{{Image: "fn:v1", ConfigMap: map[string]string{"k": "v"}, Config: map[string]any{"kind": "X"}}}},
+	} {
+		a.Error(t, pl.Validate())
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	version "github.com/Masterminds/semver/v3"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/krm-functions/catalog/pkg/api"
+	"github.com/krm-functions/catalog/pkg/helm"
+	t "github.com/krm-functions/catalog/pkg/helmspecs"
+	"github.com/krm-functions/catalog/pkg/semver"
+)
+
+// constraintRef splits a ref into a tag prefix and a semver
+// constraint, e.g. 'pkg1/v~1.4' into 'pkg1/' and 'v~1.4'. The tag
+// prefix is the part up to and including the last '/'. Refs without
+// constraint operators or wildcards, e.g. most branches and exact tags,
+// are not constraints
+func constraintRef(ref SourceRef) (prefix, constraint string, ok bool) {
+	r := string(ref)
+	if idx := strings.LastIndex(r, "/"); idx >= 0 {
+		prefix, constraint = r[:idx+1], r[idx+1:]
+	} else {
+		constraint = r
+	}
+	if !strings.ContainsAny(constraint, "~^*<>=xX") {
+		return "", "", false
+	}
+	if _, err := version.NewConstraint(constraint); err != nil {
+		return "", "", false
+	}
+	return prefix, constraint, true
+}
+
+// resolveRef resolves a semver constraint ref to the highest matching
+// tag. Other refs, and branches and tags named like a constraint, e.g.
+// 'v1.x', are returned unmodified
+func (src *PackageSource) resolveRef(ref SourceRef) (SourceRef, error) {
+	prefix, constraint, ok := constraintRef(ref)
+	if !ok {
+		return ref, nil
+	}
+	tags, err := src.listTags()
+	if err != nil {
+		return "", err
+	}
+	if slices.Contains(tags, string(ref)) {
+		return ref, nil
+	}
+	if src.Type == api.PackageUpstreamTypeGit {
+		branches, err := src.Git.ListBranches()
+		if err != nil {
+			return "", err
+		}
+		if slices.Contains(branches, string(ref)) {
+			return ref, nil
+		}
+	}
+	var versions []string
+	for _, tag := range tags {
+		if v, found := strings.CutPrefix(tag, prefix); found {
+			versions = append(versions, v)
+		}
+	}
+	v, err := semver.Upgrade(versions, constraint)
+	if err != nil {
+		return "", fmt.Errorf("resolving ref %v: %w", ref, err)
+	}
+	return SourceRef(prefix + v), nil
+}
+
+// listTags lists tags of git and OCI sources and versions of Helm chart sources
+func (src *PackageSource) listTags() ([]string, error) {
+	switch src.Type {
+	case api.PackageUpstreamTypeGit:
+		return src.Git.ListTags()
+	case api.PackageUpstreamTypeOCI:
+		repo, err := name.NewRepository(src.OCI.Image)
+		if err != nil {
+			return nil, fmt.Errorf("parsing image repository: %w", err)
+		}
+		return remote.List(repo, src.remoteOptions()...)
+	case api.PackageUpstreamTypeHelmChart:
+		args := &t.HelmChartArgs{Repo: src.HelmChart.Repo, Name: src.HelmChart.Name}
+		search, err := helm.SearchRepo(args, &src.Username, &src.Password)
+		if err != nil {
+			return nil, err
+		}
+		return helm.ToList(helm.FilterByChartName(search, args)), nil
+	}
+	return nil, fmt.Errorf("upstream type %v does not support semver refs", src.Type)
+}
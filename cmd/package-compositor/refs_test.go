@@ -0,0 +1,114 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"io"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/krm-functions/catalog/pkg/api"
+	"github.com/krm-functions/catalog/pkg/git/gittest"
+	a "github.com/stretchr/testify/assert"
+)
+
+func TestConstraintRef(t *testing.T) {
+	tests := []struct {
+		ref        SourceRef
+		prefix     string
+		constraint string
+		ok         bool
+	}{
+		{"main", "", "", false},
+		{"v1.4.2", "", "", false},
+		{"feature/fix-x", "", "", false},
+		{"~1.4", "", "~1.4", true},
+		{">=1.2, <2", "", ">=1.2, <2", true},
+		{"pkg1/v*", "pkg1/", "v*", true},
+		{"team/pkg1/^1.0", "team/pkg1/", "^1.0", true},
+	}
+	for _, tc := range tests {
+		prefix, constraint, ok := constraintRef(tc.ref)
+		a.Equal(t, tc.ok, ok, tc.ref)
+		a.Equal(t, tc.prefix, prefix, tc.ref)
+		a.Equal(t, tc.constraint, constraint, tc.ref)
+	}
+}
+
+func TestResolveRef(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	image := strings.TrimPrefix(server.URL, "http://") + "/packages"
+	for _, tag := range []string{"v1.3.0", "v1.4.1", "v1.4.3", "v2.0.0", "latest"} {
+		pushPackage(t, image+":"+tag, "  value: "+tag+"\n")
+	}
+
+	u := &Upstream{Name: "oci", Type: api.PackageUpstreamTypeOCI, OCI: UpstreamOCI{Image: image}}
+	src, _, err := NewPackageSource(u, t.TempDir(), "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := src.resolveRef("~1.4")
+	a.NoError(t, err)
+	a.Equal(t, SourceRef("v1.4.3"), ref)
+	ref, err = src.resolveRef("v*")
+	a.NoError(t, err)
+	a.Equal(t, SourceRef("v2.0.0"), ref)
+	ref, err = src.resolveRef("latest")
+	a.NoError(t, err)
+	a.Equal(t, SourceRef("latest"), ref)
+	_, err = src.resolveRef("~3.0")
+	a.Error(t, err)
+
+	fleet := strings.Replace(ociFleet(image), "ref: v1", `ref: "~1.4"`, 1)
+	cm, lock := composed(t, compose(t, fleet, ""))
+	value, _, _ := cm.NestedString("data", "value")
+	a.Equal(t, "v1.4.3", value)
+	a.Equal(t, SourceRef("~1.4"), lock.Spec.Packages[0].Ref)
+	a.Equal(t, "v1.4.3", lock.Spec.Packages[0].Tag)
+}
+
+func TestResolveRefBranch(t *testing.T) {
+	repoDir := t.TempDir()
+	repo, err := gogit.PlainInit(repoDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := gittest.CommitFiles(t, repo, repoDir, map[string]string{"pkg1/cm.yaml": configMap("one")})
+	if _, err = repo.CreateTag("v1.0.0", plumbing.NewHash(first), nil); err != nil {
+		t.Fatal(err)
+	}
+	second := gittest.CommitFiles(t, repo, repoDir, map[string]string{"pkg1/cm.yaml": configMap("two")})
+	if err = repo.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName("v1.x"), plumbing.NewHash(second))); err != nil {
+		t.Fatal(err)
+	}
+
+	u := &Upstream{Name: "git", Type: api.PackageUpstreamTypeGit, Git: UpstreamGit{Repo: repoDir}}
+	src, _, err := NewPackageSource(u, t.TempDir(), t.TempDir(), "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Branches named like a constraint are used as is
+	ref, err := src.resolveRef("v1.x")
+	a.NoError(t, err)
+	a.Equal(t, SourceRef("v1.x"), ref)
+	ref, err = src.resolveRef("v1.*")
+	a.NoError(t, err)
+	a.Equal(t, SourceRef("v1.0.0"), ref)
+}
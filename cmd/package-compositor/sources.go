@@ -0,0 +1,409 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"archive/tar"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/krm-functions/catalog/pkg/api"
+	"github.com/krm-functions/catalog/pkg/helm"
+	t "github.com/krm-functions/catalog/pkg/helmspecs"
+	"github.com/krm-functions/catalog/pkg/kpt"
+	"sigs.k8s.io/kustomize/kyaml/kio"
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// key identifies the upstream source independent of upstream name
+func (u *Upstream) key() string {
+	switch u.Type {
+	case api.PackageUpstreamTypeOCI:
+		return u.OCI.Image
+	case api.PackageUpstreamTypeHelmChart:
+		return u.HelmChart.Repo + "/" + u.HelmChart.Name
+	case api.PackageUpstreamTypeLocal:
+		return u.Local.path
+	}
+	return u.Git.Repo
+}
+
+// sameSource returns true if u and o are served by the same source
+func (u *Upstream) sameSource(o *Upstream) bool {
+	if u.Type != o.Type {
+		return false
+	}
+	switch u.Type {
+	case api.PackageUpstreamTypeOCI:
+		return u.OCI == o.OCI
+	case api.PackageUpstreamTypeHelmChart:
+		return u.HelmChart == o.HelmChart
+	case api.PackageUpstreamTypeLocal:
+		return u.Local == o.Local
+	}
+	return u.Git == o.Git
+}
+
+// Revision is a source fetched at a given ref
+type Revision struct {
+	// Ref used for fetching, i.e. possibly resolved from a semver constraint
+	Ref SourceRef
+	// Git commit, OCI digest or chart sum. Empty for local sources
+	Commit string
+	// Local directory holding the files of the revision
+	Path string
+}
+
+// fetch is a ref or commit fetched once by the first user, other users
+// wait for and share the result
+type fetch struct {
+	once sync.Once
+	rev  *Revision
+	err  error
+}
+
+// refDir returns the local directory used for a given ref of OCI and
+// Helm chart sources
+func (src *PackageSource) refDir(ref SourceRef) string {
+	return filepath.Join(src.base, base64.URLEncoding.EncodeToString([]byte(ref)))
+}
+
+// packageDir returns the local directory holding files of a package
+// at a given revision. Helm chart sources contain a single package,
+// i.e. 'sourcePath' is not used.
+func (src *PackageSource) packageDir(rev *Revision, srcPath string) string {
+	if src.Type == api.PackageUpstreamTypeHelmChart {
+		return rev.Path
+	}
+	return filepath.Join(rev.Path, srcPath)
+}
+
+// upstream returns the upstream information recorded in the Kptfile
+// of a package at a given revision
+func (src *PackageSource) upstream(revision *Revision, p *Package) *kpt.Upstream {
+	rev, commit := string(revision.Ref), revision.Commit
+	switch src.Type {
+	case api.PackageUpstreamTypeOCI:
+		return &kpt.Upstream{
+			Type:      api.PackageUpstreamTypeOCI,
+			Repo:      src.OCI.Image,
+			Directory: "/" + p.SrcPath,
+			Ref:       rev,
+			Lock:      commit,
+		}
+	case api.PackageUpstreamTypeHelmChart:
+		return &kpt.Upstream{
+			Type: api.PackageUpstreamTypeHelmChart,
+			Repo: src.HelmChart.Repo,
+			Name: src.HelmChart.Name,
+			Ref:  rev,
+			Lock: commit,
+		}
+	case api.PackageUpstreamTypeLocal:
+		return &kpt.Upstream{
+			Type:      api.PackageUpstreamTypeLocal,
+			Directory: filepath.Join(src.Local.path, p.SrcPath),
+		}
+	}
+	// Semver constraint refs are recorded in upstream and the resolved tag in the lock
+	return kpt.GitUpstream(src.Git.URI, p.SrcPath, string(p.Ref), rev, commit)
+}
+
+// NewLocalPackageSource creates a source from the resources of items
+// located below the directory of a local upstream. Resources are
+// written to a local directory such that they can be copied like
+// files from other upstreams.
+func NewLocalPackageSource(u *Upstream, fileBase string, items fn.KubeObjects) (*PackageSource, error) {
+	localPath := filepath.Join(fileBase, base64.URLEncoding.EncodeToString([]byte(u.Type+"+"+u.key())))
+	var nodes []*yaml.RNode
+	for _, item := range items {
+		rel, err := filepath.Rel(u.Local.path, item.GetAnnotation(kioutil.PathAnnotation))
+		if err != nil || !filepath.IsLocal(rel) {
+			continue
+		}
+		node, err := relocate(item, rel)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("upstream %v, no resources found in local directory %v", u.Name, u.Local.path)
+	}
+	if err := writeResources(localPath, nodes); err != nil {
+		return nil, fmt.Errorf("writing local upstream %v: %w", u.Name, err)
+	}
+	return &PackageSource{
+		Type:  api.PackageUpstreamTypeLocal,
+		Local: &u.Local,
+		Path:  localPath,
+		refs:  []SourceRef{}}, nil
+}
+
+// relocate returns a copy of item with path annotations set to path
+func relocate(item *fn.KubeObject, path string) (*yaml.RNode, error) {
+	node, err := yaml.Parse(item.String())
+	if err != nil {
+		return nil, err
+	}
+	for _, anno := range []kioutil.AnnotationKey{kioutil.PathAnnotation, kioutil.LegacyPathAnnotation} {
+		if err = node.PipeE(yaml.SetAnnotation(anno, path)); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+// writeResources writes nodes to files below dir according to their path annotations
+func writeResources(dir string, nodes []*yaml.RNode) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	w := kio.LocalPackageWriter{PackagePath: dir}
+	return w.Write(nodes)
+}
+
+// Fetch makes the files of src at ref available locally. If locked is
+// non-empty, the locked commit (or digest) is used instead of resolving
+// ref. Fetch is safe for concurrent use, and each commit and OCI or
+// Helm chart ref is only fetched once
+func (src *PackageSource) Fetch(ref SourceRef, locked string) (*Revision, fn.Results, error) {
+	switch src.Type {
+	case api.PackageUpstreamTypeLocal:
+		return &Revision{Ref: ref, Path: src.Path}, nil, nil
+	case api.PackageUpstreamTypeGit:
+		return src.fetchGit(ref, locked)
+	}
+	lockedInfo := ""
+	if locked != "" {
+		lockedInfo = ", locked"
+	}
+	// Charts cannot be fetched by chart sum, i.e. locked sums are verified after fetch
+	fetchRef := ref
+	if locked != "" && src.Type == api.PackageUpstreamTypeOCI {
+		fetchRef = SourceRef(locked)
+	}
+	rev, fnResults, err := src.once(string(fetchRef), func() (*Revision, fn.Results, error) {
+		var fnResults fn.Results
+		start := time.Now()
+		var digest string
+		var err error
+		if src.Type == api.PackageUpstreamTypeOCI {
+			digest, err = src.fetchOCI(fetchRef)
+		} else {
+			digest, err = src.fetchHelmChart(fetchRef)
+		}
+		if err != nil {
+			fnResults = append(fnResults, fn.GeneralResult(fmt.Sprintf("error fetching %v@%v\n", src.Type, ref), fn.Error))
+			return nil, fnResults, err
+		}
+		elapsed := time.Since(start).Truncate(time.Millisecond)
+		fnResults = append(fnResults, fn.GeneralResult(fmt.Sprintf("fetched %v@%v (%v%v) in %v\n", src.Type, ref, digest, lockedInfo, elapsed), fn.Info))
+		return &Revision{Ref: fetchRef, Commit: digest, Path: src.refDir(fetchRef)}, fnResults, nil
+	})
+	if err != nil {
+		return nil, fnResults, err
+	}
+	if locked != "" && rev.Commit != locked {
+		return nil, fnResults, fmt.Errorf("%v@%v: %v does not match locked %v", src.Type, ref, rev.Commit, locked)
+	}
+	return &Revision{Ref: ref, Commit: rev.Commit, Path: rev.Path}, fnResults, nil
+}
+
+// fetchGit resolves ref (or uses the locked commit) and reads the tree
+// of the commit into a directory per commit
+func (src *PackageSource) fetchGit(ref SourceRef, locked string) (*Revision, fn.Results, error) {
+	var fnResults fn.Results
+	lockedInfo := ""
+	revision := string(ref)
+	if locked != "" {
+		lockedInfo = ", locked"
+		revision = locked
+	}
+	commit, err := src.Git.ResolveRevision(revision)
+	if err != nil {
+		fnResults = append(fnResults, fn.GeneralResult(fmt.Sprintf("error fetching %v@%v\n", src.Upstream.Repo, ref), fn.Error))
+		return nil, fnResults, err
+	}
+	rev, fnResults, err := src.once(commit, func() (*Revision, fn.Results, error) {
+		var fnResults fn.Results
+		start := time.Now()
+		dir := filepath.Join(src.base, commit)
+		if _, err := src.Git.ExtractTree(commit, dir); err != nil {
+			fnResults = append(fnResults, fn.GeneralResult(fmt.Sprintf("error fetching %v@%v\n", src.Upstream.Repo, ref), fn.Error))
+			return nil, fnResults, err
+		}
+		elapsed := time.Since(start).Truncate(time.Millisecond)
+		fnResults = append(fnResults, fn.GeneralResult(fmt.Sprintf("fetched %v@%v (%v%v) in %v\n", src.Upstream.Repo, ref, commit, lockedInfo, elapsed), fn.Info))
+		return &Revision{Commit: commit, Path: dir}, fnResults, nil
+	})
+	if err != nil {
+		return nil, fnResults, err
+	}
+	return &Revision{Ref: ref, Commit: commit, Path: rev.Path}, fnResults, nil
+}
+
+// once calls f for the first user of key. Results are only returned
+// to the first user
+func (src *PackageSource) once(key string, f func() (*Revision, fn.Results, error)) (*Revision, fn.Results, error) {
+	src.mu.Lock()
+	ft, found := src.fetches[key]
+	if !found {
+		ft = &fetch{}
+		src.fetches[key] = ft
+	}
+	src.mu.Unlock()
+	var fnResults fn.Results
+	ft.once.Do(func() {
+		ft.rev, fnResults, ft.err = f()
+	})
+	return ft.rev, fnResults, ft.err
+}
+
+func isDigest(ref string) bool {
+	return strings.HasPrefix(ref, "sha256:")
+}
+
+// fetchOCI pulls an OCI artifact and extracts the layers into the directory of ref
+func (src *PackageSource) fetchOCI(ref SourceRef) (string, error) {
+	sep := ":"
+	if isDigest(string(ref)) {
+		sep = "@"
+	}
+	imgRef, err := name.ParseReference(src.OCI.Image + sep + string(ref))
+	if err != nil {
+		return "", fmt.Errorf("parsing image reference: %w", err)
+	}
+	img, err := remote.Image(imgRef, src.remoteOptions()...)
+	if err != nil {
+		return "", fmt.Errorf("pulling %v: %w", imgRef, err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return "", err
+	}
+	rc := mutate.Extract(img)
+	defer rc.Close()
+	if err = extractTar(rc, src.refDir(ref)); err != nil {
+		return "", fmt.Errorf("extracting %v: %w", imgRef, err)
+	}
+	return digest.String(), nil
+}
+
+// remoteOptions returns registry options of OCI sources
+func (src *PackageSource) remoteOptions() []remote.Option {
+	if src.Username != "" || src.Password != "" {
+		return []remote.Option{remote.WithAuth(&authn.Basic{Username: src.Username, Password: src.Password})}
+	}
+	return []remote.Option{remote.WithAuthFromKeychain(authn.DefaultKeychain)}
+}
+
+// extractTar extracts regular files and directories from a tar stream
+func extractTar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fname := filepath.Clean(hdr.Name)
+		if !filepath.IsLocal(fname) {
+			return fmt.Errorf("invalid path in archive: %v", hdr.Name)
+		}
+		target := filepath.Join(dir, fname)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(target, 0o700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err = os.MkdirAll(filepath.Dir(target), 0o700); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr) //nolint:gosec // package files, size bounded by artifact
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// fetchHelmChart pulls a chart and creates a package with a
+// RenderHelmChart resource embedding the chart
+func (src *PackageSource) fetchHelmChart(ref SourceRef) (string, error) {
+	args := t.HelmChartArgs{
+		Repo:    src.HelmChart.Repo,
+		Name:    src.HelmChart.Name,
+		Version: string(ref),
+	}
+	chartData, _, chartSum, err := helm.SourceChart(&args, "", &src.Username, &src.Password)
+	if err != nil {
+		return "", err
+	}
+	err = writeChartPackage(src.refDir(ref), &args, chartData, chartSum)
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + chartSum, nil
+}
+
+// writeChartPackage writes a RenderHelmChart resource with embedded chart to dir
+func writeChartPackage(dir string, args *t.HelmChartArgs, chartData []byte, chartSum string) error {
+	obj := fn.NewEmptyKubeObject()
+	if err := obj.SetAPIVersion(api.HelmResourceAPIVersion); err != nil {
+		return err
+	}
+	if err := obj.SetKind("RenderHelmChart"); err != nil {
+		return err
+	}
+	if err := obj.SetName(args.Name); err != nil {
+		return err
+	}
+	if err := obj.SetAnnotation(api.HelmResourceAnnotationShaSum+"/"+args.Name, "sha256:"+chartSum); err != nil {
+		return err
+	}
+	charts := []t.HelmChart{{
+		Args:    *args,
+		Options: t.HelmTemplateOptions{ReleaseName: args.Name},
+		Chart:   base64.StdEncoding.EncodeToString(chartData),
+	}}
+	if err := obj.SetNestedField(charts, "helmCharts"); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, args.Name+"-chart.yaml"), []byte(obj.String()), 0o600)
+}
@@ -0,0 +1,119 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/krm-functions/catalog/pkg/api"
+	t "github.com/krm-functions/catalog/pkg/helmspecs"
+	"github.com/krm-functions/catalog/pkg/kpt"
+	kptfile "github.com/nephio-project/porch/pkg/kpt/api/kptfile/v1"
+	a "github.com/stretchr/testify/assert"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+func TestOCISource(tt *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	image := strings.TrimPrefix(server.URL, "http://") + "/packages"
+
+	img, err := crane.Image(map[string][]byte{
+		"pkg1/Kptfile": []byte("apiVersion: kpt.dev/v1\nkind: Kptfile\nmetadata:\n  name: pkg1\n"),
+		"pkg1/cm.yaml": []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm\n"),
+	})
+	if err != nil {
+		tt.Fatal(err)
+	}
+	ref, err := name.ParseReference(image + ":v1.0")
+	if err != nil {
+		tt.Fatal(err)
+	}
+	if err = remote.Write(ref, img); err != nil {
+		tt.Fatal(err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		tt.Fatal(err)
+	}
+
+	u := &Upstream{Name: "oci", Type: api.PackageUpstreamTypeOCI, OCI: UpstreamOCI{Image: image}}
+	src, _, err := NewPackageSource(u, tt.TempDir(), "", "", "", "")
+	if err != nil {
+		tt.Fatal(err)
+	}
+	rev, _, err := src.Fetch("v1.0", "")
+	if err != nil {
+		tt.Fatal(err)
+	}
+	p := &Package{Name: "foo", SrcPath: "pkg1"}
+	cm, err := os.ReadFile(filepath.Join(src.packageDir(rev, p.SrcPath), "cm.yaml"))
+	a.NoError(tt, err)
+	a.Contains(tt, string(cm), "name: cm")
+
+	dst := tt.TempDir()
+	err = kpt.UpdateKptMetadata(dst, p.Name, map[string]string{"name": p.Name}, src.upstream(rev, p))
+	if err != nil {
+		tt.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dst, "Kptfile"))
+	if err != nil {
+		tt.Fatal(err)
+	}
+	// kpt rejects unknown Kptfile fields
+	kf := &kptfile.KptFile{}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	a.NoError(tt, dec.Decode(kf))
+	a.Nil(tt, kf.Upstream)
+	a.Equal(tt, map[string]string{
+		kpt.UpstreamTypeAnnotation:      "oci",
+		kpt.UpstreamRepoAnnotation:      image,
+		kpt.UpstreamDirectoryAnnotation: "/pkg1",
+		kpt.UpstreamRefAnnotation:       "v1.0",
+		kpt.UpstreamLockAnnotation:      digest.String(),
+	}, kf.Annotations)
+}
+
+func TestWriteChartPackage(tt *testing.T) {
+	dir := tt.TempDir()
+	args := &t.HelmChartArgs{Repo: "https://charts.example.com", Name: "example", Version: "1.2.3"}
+	err := writeChartPackage(dir, args, []byte("chart-data"), "abc")
+	if err != nil {
+		tt.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "example-chart.yaml"))
+	if err != nil {
+		tt.Fatal(err)
+	}
+	spec, err := t.ParseKptSpec(b)
+	if err != nil {
+		tt.Fatal(err)
+	}
+	a.Equal(tt, *args, spec.Charts[0].Args)
+	a.Equal(tt, "example", spec.Charts[0].Options.ReleaseName)
+	a.Equal(tt, "Y2hhcnQtZGF0YQ==", spec.Charts[0].Chart)
+	a.Contains(tt, string(b), api.HelmResourceAnnotationShaSum+"/example: sha256:abc")
+}
@@ -16,6 +16,7 @@ package main
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"os"
 
@@ -23,6 +24,7 @@ import (
 	"github.com/krm-functions/catalog/pkg/api"
 	"github.com/krm-functions/catalog/pkg/helm"
 	t "github.com/krm-functions/catalog/pkg/helmspecs"
+	"github.com/krm-functions/catalog/pkg/postrender"
 	"github.com/krm-functions/catalog/pkg/util"
 )
 
@@ -35,6 +37,28 @@ func Run(rl *fn.ResourceList) (bool, error) {
 		Severity: fn.Info,
 	})
 
+	// Objects simulating cluster state for the Helm 'lookup' function
+	lookupObjects, err := helm.LookupObjects(rl.Items)
+	if err != nil {
+		return false, err
+	}
+	profile, err := helm.ClusterProfileFromObjects(rl.Items)
+	if err != nil {
+		return false, err
+	}
+	var cluster *helm.FakeCluster
+	if len(lookupObjects) > 0 {
+		cluster, err = helm.NewFakeCluster(lookupObjects)
+		if err != nil {
+			return false, fmt.Errorf("creating fake cluster for lookup: %w", err)
+		}
+		defer cluster.Close()
+		results = append(results, &fn.Result{
+			Message:  fmt.Sprintf("lookup function enabled with %d objects", len(lookupObjects)),
+			Severity: fn.Info,
+		})
+	}
+
 	for _, kubeObject := range rl.Items {
 		switch {
 		case kubeObject.IsGVK(api.HelmResourceAPI, "", "RenderHelmChart"):
@@ -49,6 +73,9 @@ func Run(rl *fn.ResourceList) (bool, error) {
 				}
 			}
 			for idx := range spec.Charts {
+				if profile != nil {
+					profile.ApplyDefaults(&spec.Charts[idx].Options)
+				}
 				chartTarball, err := base64.StdEncoding.DecodeString(spec.Charts[idx].Chart)
 				if err != nil {
 					return false, err
@@ -56,13 +83,30 @@ func Run(rl *fn.ResourceList) (bool, error) {
 				if len(chartTarball) == 0 {
 					return false, fmt.Errorf("no embedded chart found")
 				}
-				rendered, err := helm.Template(&spec.Charts[idx], chartTarball)
+				rendered, err := helm.Template(&spec.Charts[idx], chartTarball, cluster)
+				var missingDeps *helm.MissingDependenciesError
+				if errors.As(err, &missingDeps) {
+					for _, d := range missingDeps.Missing {
+						results = append(results, fn.ConfigObjectResult(
+							fmt.Sprintf("chart %v: missing dependency %v", missingDeps.Chart, d), kubeObject, fn.Error))
+					}
+					rl.Results = results
+					return false, nil
+				}
 				if err != nil {
 					return false, err
 				}
-				newobjs, err := helm.ParseAsKubeObjects(rendered)
+				newobjs, parseResults, err := helm.ParseAsKubeObjects(rendered, spec.Charts[idx].Options.ParseMode != t.ParseModeLenient)
+				results = append(results, parseResults...)
 				if err != nil {
-					return false, err
+					rl.Results = results
+					return false, fmt.Errorf("chart %v: %w", spec.Charts[idx].Args.Name, err)
+				}
+				newobjs, postResults, err := postrender.Run(spec.Charts[idx].Options.PostRenderers, newobjs)
+				results = append(results, postResults...)
+				if err != nil {
+					rl.Results = results
+					return false, fmt.Errorf("chart %v: %w", spec.Charts[idx].Args.Name, err)
 				}
 				outputs = append(outputs, newobjs...)
 			}
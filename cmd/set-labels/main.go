@@ -18,44 +18,19 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/krm-functions/catalog/pkg/setlabels"
 	"github.com/krm-functions/catalog/pkg/version"
 
-	corev1 "k8s.io/api/core/v1"
 	"sigs.k8s.io/kustomize/kyaml/fn/framework"
 	"sigs.k8s.io/kustomize/kyaml/fn/framework/command"
 	"sigs.k8s.io/kustomize/kyaml/yaml"
 )
 
-type SetLabels struct {
-	Labels            map[string]string `json:"labels,omitempty"`
-	SetSelectorLabels *bool             `json:"setSelectorLabels,omitempty"`
-}
-
 type FilterState struct {
-	fnConfig *SetLabels
+	fnConfig *setlabels.SetLabels
 	Results  framework.Results
 }
 
-func (fnCfg *SetLabels) LoadFunctionConfig(o *yaml.RNode) error {
-	if o.GetKind() == "ConfigMap" && o.GetApiVersion() == "v1" {
-		var cm corev1.ConfigMap
-		if err := yaml.Unmarshal([]byte(o.MustString()), &cm); err != nil {
-			return err
-		}
-		fnCfg.Labels = cm.Data
-		return nil
-	} else if o.GetKind() == "SetLabels" && o.GetApiVersion() == "fn.kpt.dev/v1alpha1" {
-		if err := yaml.Unmarshal([]byte(o.MustString()), &fnCfg); err != nil {
-			return err
-		}
-		if fnCfg.SetSelectorLabels != nil && *fnCfg.SetSelectorLabels {
-			return fmt.Errorf("function does not support setting selector labels")
-		}
-		return nil
-	}
-	return fmt.Errorf("unknown function config")
-}
-
 func (f *FilterState) Each(items []*yaml.RNode) ([]*yaml.RNode, error) {
 	var err error
 	for _, item := range items {
@@ -65,16 +40,12 @@ func (f *FilterState) Each(items []*yaml.RNode) ([]*yaml.RNode, error) {
 }
 
 func (f *FilterState) Filter(object *yaml.RNode) (*yaml.RNode, error) {
-	err := object.SetLabels(f.fnConfig.Labels)
-	if err != nil {
-		return object, err
-	}
-	return object, nil
+	return f.fnConfig.Filter(object)
 }
 
 func Processor() framework.ResourceListProcessor {
 	return framework.ResourceListProcessorFunc(func(rl *framework.ResourceList) error {
-		config := &SetLabels{}
+		config := &setlabels.SetLabels{}
 		if err := config.LoadFunctionConfig(rl.FunctionConfig); err != nil {
 			return fmt.Errorf("reading function-config: %w", err)
 		}
@@ -50,6 +50,12 @@ func Run(rl *fn.ResourceList) (bool, error) {
 				if err != nil {
 					return false, err
 				}
+				if chart.Args.VendorDependencies {
+					chartData, err = helm.VendorDependencies(&chart.Args, chartData, &uname, &pword)
+					if err != nil {
+						return false, fmt.Errorf("vendoring dependencies of chart %v: %w", chart.Args.Name, err)
+					}
+				}
 				err = kubeObject.SetAPIVersion(api.HelmResourceAPIVersion)
 				if err != nil {
 					return false, err
@@ -3,6 +3,8 @@ package api
 const (
 	HelmResourceAPI                         = "experimental.helm.sh"
 	HelmResourceAnnotationShaSum            = HelmResourceAPI + "/chart-sum"
+	HelmResourceAnnotationImageSignatures   = HelmResourceAPI + "/image-signatures"
+	HelmResourceAnnotationLookupObject      = HelmResourceAPI + "/lookup-object"
 	HelmResourceAnnotationUpgradeAvailable  = HelmResourceAPI + "/upgrade-available"
 	HelmResourceAnnotationUpgradeConstraint = HelmResourceAPI + "/upgrade-constraint"
 	HelmResourceAnnotationUpgradeShaSum     = HelmResourceAPI + "/upgrade-chart-sum"
@@ -10,5 +12,8 @@ const (
 
 	KptResourceAPI = "fn.kpt.dev"
 
-	PackageUpstreamTypeGit = "git"
+	PackageUpstreamTypeGit       = "git"
+	PackageUpstreamTypeOCI       = "oci"
+	PackageUpstreamTypeHelmChart = "helmChart"
+	PackageUpstreamTypeLocal     = "local"
 )
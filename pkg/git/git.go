@@ -14,125 +14,428 @@
 package git
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
 	gogit "github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
 	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	gossh "golang.org/x/crypto/ssh"
 )
 
+const (
+	AuthMethodSSHAgent      = "sshAgent"
+	AuthMethodSSHPrivateKey = "sshPrivateKey"
+	AuthMethodHTTPSToken    = "httpsToken"
+	AuthMethodHTTPSBasic    = "httpsBasic"
+)
+
+// Mirrors fetch all branches and tags
+var mirrorRefSpecs = []config.RefSpec{
+	"+refs/heads/*:refs/heads/*",
+	"+refs/tags/*:refs/tags/*",
+}
+
+// File in mirror directories recording the repository URI. The
+// modification time is the time the mirror was last used
+const mirrorUsedFile = "mirror-used"
+
+// Repository is a bare mirror. Files of a revision are read from git
+// objects, such that multiple revisions can be used concurrently.
+// Repository methods are safe for concurrent use, also by other
+// processes using the same mirror.
 type Repository struct {
-	URI             string
-	Repo            *gogit.Repository
-	Tree            *gogit.Worktree
-	AuthMethod      ssh.AuthMethod
-	CurrentRevision string
-	CurrentHash     string
+	URI        string
+	Repo       *gogit.Repository
+	AuthMethod transport.AuthMethod
+	// Object access of the underlying storage is not concurrency safe,
+	// shared between repositories using the same mirror
+	locker *mirrorLocker
 }
 
-func Clone(uri, authMethod, username, password, fileBase string) (*Repository, error) {
-	var err error
-	var auth ssh.AuthMethod
-	opts := &gogit.CloneOptions{
-		URL:   uri,
-		Depth: 1,
+// mirrorLocker serializes use of a mirror directory, within the process
+// through a mutex and between processes through a lock file next to the
+// mirror directory. Lock files are never removed, since processes
+// waiting for the lock would otherwise lock a removed file
+type mirrorLocker struct {
+	mu       sync.Mutex
+	lockFile string
+}
+
+// lock locks the mirror and returns a function releasing the lock
+func (l *mirrorLocker) lock() (func(), error) {
+	l.mu.Lock()
+	f, err := lockFile(l.lockFile)
+	if err != nil {
+		l.mu.Unlock()
+		return nil, fmt.Errorf("locking mirror: %v", err)
 	}
-	if authMethod == "sshAgent" {
-		auth, err = ssh.NewSSHAgentAuth(username)
-		if err != nil {
-			return nil, fmt.Errorf("sshAgent auth setup %v: %v", uri, err)
+	return func() {
+		f.Close() // Releases the file lock
+		l.mu.Unlock()
+	}, nil
+}
+
+var (
+	mirrorLocksMu sync.Mutex
+	mirrorLocks   = map[string]*mirrorLocker{}
+)
+
+// mirrorLock returns the locker of a mirror directory
+func mirrorLock(path string) *mirrorLocker {
+	mirrorLocksMu.Lock()
+	defer mirrorLocksMu.Unlock()
+	l, found := mirrorLocks[path]
+	if !found {
+		l = &mirrorLocker{lockFile: path + ".lock"}
+		mirrorLocks[path] = l
+	}
+	return l
+}
+
+// mirrorPath returns the mirror directory of a repository in cacheDir
+func mirrorPath(cacheDir, uri string) string {
+	sum := sha256.Sum256([]byte(uri))
+	return filepath.Join(cacheDir, hex.EncodeToString(sum[:]))
+}
+
+// Mirror opens the bare mirror of a repository in cacheDir, creating it
+// if it does not exist, and fetches all branches and tags
+// incrementally. For SSH auth methods, host keys are verified against
+// knownHosts if not empty, otherwise against the default known_hosts
+// files. For 'httpsToken', password is the token
+func Mirror(uri, authMethod, username, password, knownHosts, cacheDir string) (*Repository, error) {
+	auth, err := authSetup(uri, authMethod, username, password, knownHosts)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(cacheDir, 0o700); err != nil {
+		return nil, err
+	}
+	path := mirrorPath(cacheDir, uri)
+	locker := mirrorLock(path)
+	unlock, err := locker.lock()
+	if err != nil {
+		return nil, fmt.Errorf("opening mirror of %v: %v", uri, err)
+	}
+	defer unlock()
+	created := false
+	repo, err := gogit.PlainOpen(path)
+	if errors.Is(err, gogit.ErrRepositoryNotExists) {
+		created = true
+		repo, err = gogit.PlainInit(path, true)
+		if err == nil {
+			_, err = repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{uri}, Fetch: mirrorRefSpecs})
 		}
-	} else if authMethod == "sshPrivateKey" {
-		auth, err = ssh.NewPublicKeys(username, []byte(password), "")
-		if err != nil {
-			return nil, fmt.Errorf("sshPrivateKey auth setup %v: %v", uri, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening mirror of %v: %v", uri, err)
+	}
+	r := &Repository{
+		URI:        uri,
+		Repo:       repo,
+		AuthMethod: auth,
+		locker:     locker,
+	}
+	if err = r.fetchOrigin(mirrorRefSpecs...); err != nil {
+		if created {
+			os.RemoveAll(path)
 		}
+		return nil, fmt.Errorf("fetching %v, authMethod: %v: %v", uri, authMethod, err)
 	}
-	opts.Auth = auth
-	repo, err := gogit.PlainClone(fileBase, false, opts)
+	if err = r.updateHead(); err != nil {
+		return nil, fmt.Errorf("updating HEAD of %v: %v", uri, err)
+	}
+	if err = os.WriteFile(filepath.Join(path, mirrorUsedFile), []byte(uri), 0o600); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// updateHead points HEAD of the mirror to the default branch of the remote
+func (r *Repository) updateHead() error {
+	remote, err := r.Repo.Remote("origin")
 	if err != nil {
-		return nil, fmt.Errorf("cloning %v, authMethod: %v: %v", uri, authMethod, err)
+		return err
 	}
-	tree, err := repo.Worktree()
+	refs, err := remote.List(&gogit.ListOptions{Auth: r.AuthMethod})
 	if err != nil {
-		return nil, fmt.Errorf("creating worktree: %v", err)
+		return err
 	}
-	r := &Repository{
-		URI:             uri,
-		Repo:            repo,
-		Tree:            tree,
-		AuthMethod:      auth,
-		CurrentRevision: "HEAD",
-		CurrentHash:     "",
+	for _, ref := range refs {
+		if ref.Name() == plumbing.HEAD && ref.Type() == plumbing.SymbolicReference {
+			return r.Repo.Storer.SetReference(ref)
+		}
+	}
+	return nil
+}
+
+// PruneMirrors removes mirrors in cacheDir not used within maxAge and
+// returns the URIs of the removed mirrors
+func PruneMirrors(cacheDir string, maxAge time.Duration) ([]string, error) {
+	entries, err := os.ReadDir(cacheDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
 	}
-	hash, err := r.ResolveRevision("HEAD")
 	if err != nil {
-		return nil, fmt.Errorf("resolving HEAD: %v", err)
+		return nil, err
 	}
-	r.CurrentHash = hash
-	return r, nil
+	var removed []string
+	for _, e := range entries {
+		path := filepath.Join(cacheDir, e.Name())
+		info, err := os.Stat(filepath.Join(path, mirrorUsedFile))
+		if err != nil || !e.IsDir() {
+			continue // Not a mirror
+		}
+		if time.Since(info.ModTime()) <= maxAge {
+			continue
+		}
+		uri, err := pruneMirror(path, maxAge)
+		if err != nil {
+			return removed, err
+		}
+		if uri != "" {
+			removed = append(removed, uri)
+		}
+	}
+	return removed, nil
 }
 
-func (r *Repository) ResolveRevision(treeishRevision string) (string, error) {
-	hash, err := r.Repo.ResolveRevision(plumbing.Revision(treeishRevision))
+// pruneMirror removes a mirror if still unused within maxAge once
+// locked, since it may have been used by another process meanwhile.
+// The URI of a removed mirror is returned
+func pruneMirror(path string, maxAge time.Duration) (string, error) {
+	unlock, err := mirrorLock(path).lock()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	info, err := os.Stat(filepath.Join(path, mirrorUsedFile))
+	if errors.Is(err, os.ErrNotExist) || (err == nil && time.Since(info.ModTime()) <= maxAge) {
+		return "", nil
+	}
 	if err != nil {
-		// Unknown ref, try remote branch
-		mirrorRemoteBranchRefSpec := fmt.Sprintf("refs/heads/%s:refs/heads/%s", treeishRevision, treeishRevision)
-		err = r.fetchOrigin(mirrorRemoteBranchRefSpec)
+		return "", err
+	}
+	uri, err := os.ReadFile(filepath.Join(path, mirrorUsedFile))
+	if err != nil {
+		return "", err
+	}
+	if err = os.RemoveAll(path); err != nil {
+		return "", fmt.Errorf("removing mirror of %s: %v", uri, err)
+	}
+	return string(uri), nil
+}
+
+// authSetup returns the transport auth method of a repository
+func authSetup(uri, authMethod, username, password, knownHosts string) (transport.AuthMethod, error) {
+	var hostKeyCallback gossh.HostKeyCallback
+	var err error
+	if knownHosts != "" && (authMethod == AuthMethodSSHAgent || authMethod == AuthMethodSSHPrivateKey) {
+		hostKeyCallback, err = knownHostsCallback(knownHosts)
 		if err != nil {
-			return "", fmt.Errorf("fetch remote %v@%v: %v", r.URI, treeishRevision, err)
+			return nil, fmt.Errorf("known_hosts setup %v: %v", uri, err)
 		}
-		hash, err = r.Repo.ResolveRevision(plumbing.Revision(treeishRevision))
+	}
+	switch authMethod {
+	case AuthMethodSSHAgent:
+		agentAuth, err := ssh.NewSSHAgentAuth(username)
+		if err != nil {
+			return nil, fmt.Errorf("sshAgent auth setup %v: %v", uri, err)
+		}
+		agentAuth.HostKeyCallback = hostKeyCallback
+		return agentAuth, nil
+	case AuthMethodSSHPrivateKey:
+		keyAuth, err := ssh.NewPublicKeys(username, []byte(password), "")
 		if err != nil {
-			return "", fmt.Errorf("unknown ref %v@ %v: %v", r.URI, treeishRevision, err)
+			return nil, fmt.Errorf("sshPrivateKey auth setup %v: %v", uri, err)
 		}
+		keyAuth.HostKeyCallback = hostKeyCallback
+		return keyAuth, nil
+	case AuthMethodHTTPSToken, AuthMethodHTTPSBasic:
+		// Git hosting services accept tokens as basic auth passwords
+		return &http.BasicAuth{Username: username, Password: password}, nil
+	}
+	return nil, nil
+}
+
+// ResolveRevision resolves a branch, tag or commit to a commit hash.
+// Unknown revisions are fetched by updating the mirror and commits not
+// reachable from branches and tags are fetched by hash, if supported by
+// the server
+func (r *Repository) ResolveRevision(treeishRevision string) (string, error) {
+	unlock, err := r.locker.lock()
+	if err != nil {
+		return "", err
 	}
-	return hash.String(), nil
+	defer unlock()
+	return r.resolveRevision(treeishRevision)
 }
 
-func (r *Repository) Checkout(treeishRevision string) (string, error) {
-	if r.CurrentRevision == treeishRevision {
-		return r.CurrentHash, nil // already at revision
+func (r *Repository) resolveRevision(treeishRevision string) (string, error) {
+	hash, err := r.Repo.ResolveRevision(plumbing.Revision(treeishRevision))
+	if err == nil {
+		return hash.String(), nil
+	}
+	fetches := [][]config.RefSpec{mirrorRefSpecs}
+	if refSpec := config.RefSpec(treeishRevision + ":refs/commits/" + treeishRevision); refSpec.IsExactSHA1() {
+		fetches = append(fetches, []config.RefSpec{refSpec})
+	}
+	for _, refSpecs := range fetches {
+		if err = r.fetchOrigin(refSpecs...); err != nil {
+			return "", fmt.Errorf("fetch remote %v@%v: %v", r.URI, treeishRevision, err)
+		}
+		hash, err = r.Repo.ResolveRevision(plumbing.Revision(treeishRevision))
+		if err == nil {
+			return hash.String(), nil
+		}
 	}
+	return "", fmt.Errorf("unknown ref %v@%v: %v", r.URI, treeishRevision, err)
+}
 
-	hash, err := r.ResolveRevision(treeishRevision)
+// ExtractTree writes the files of a revision to dir by reading git
+// objects, i.e. without a worktree checkout. The commit hash of the
+// revision is returned
+func (r *Repository) ExtractTree(treeishRevision, dir string) (string, error) {
+	unlock, err := r.locker.lock()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	hash, err := r.resolveRevision(treeishRevision)
 	if err != nil {
 		return "", fmt.Errorf("failed to resolve ref %v@%v: %v", r.URI, treeishRevision, err)
 	}
-	opts := gogit.CheckoutOptions{
-		Hash: plumbing.NewHash(hash),
+	commit, err := r.Repo.CommitObject(plumbing.NewHash(hash))
+	if err != nil {
+		return "", fmt.Errorf("reading commit %v@%v: %v", r.URI, hash, err)
 	}
-	if err := r.Tree.Checkout(&opts); err != nil {
-		return "", fmt.Errorf("checkout %v@%v: %v", r.URI, treeishRevision, err)
+	tree, err := commit.Tree()
+	if err != nil {
+		return "", fmt.Errorf("reading tree %v@%v: %v", r.URI, hash, err)
+	}
+	err = tree.Files().ForEach(func(f *object.File) error {
+		return writeFile(f, dir)
+	})
+	if err != nil {
+		return "", fmt.Errorf("extracting %v@%v: %v", r.URI, hash, err)
 	}
-
-	r.CurrentRevision = treeishRevision
-	r.CurrentHash = hash
 	return hash, nil
 }
 
-func (r *Repository) fetchOrigin(refSpecStr string) error {
-	remote, err := r.Repo.Remote("origin")
+// writeFile writes a file of a git tree below dir
+func writeFile(f *object.File, dir string) error {
+	if !filepath.IsLocal(f.Name) {
+		return fmt.Errorf("invalid path in tree: %v", f.Name)
+	}
+	target := filepath.Join(dir, filepath.FromSlash(f.Name))
+	if err := os.MkdirAll(filepath.Dir(target), 0o700); err != nil {
+		return err
+	}
+	if f.Mode == filemode.Symlink {
+		linkTarget, err := f.Contents()
+		if err != nil {
+			return err
+		}
+		return os.Symlink(linkTarget, target)
+	}
+	perm := os.FileMode(0o600)
+	if f.Mode == filemode.Executable {
+		perm = 0o700
+	}
+	rd, err := f.Reader()
 	if err != nil {
-		return fmt.Errorf("create remote: %v", err)
+		return err
+	}
+	defer rd.Close()
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
 	}
+	_, err = io.Copy(out, rd)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ListTags lists tags of the remote repository, similar to 'git ls-remote --tags'
+func (r *Repository) ListTags() ([]string, error) {
+	return r.listRemote(plumbing.ReferenceName.IsTag)
+}
 
-	var refSpecs []config.RefSpec
-	if refSpecStr != "" {
-		refSpecs = []config.RefSpec{config.RefSpec(refSpecStr)}
+// ListBranches lists branches of the remote repository, similar to 'git ls-remote --heads'
+func (r *Repository) ListBranches() ([]string, error) {
+	return r.listRemote(plumbing.ReferenceName.IsBranch)
+}
+
+// listRemote lists the short names of remote references selected by match
+func (r *Repository) listRemote(match func(plumbing.ReferenceName) bool) ([]string, error) {
+	unlock, err := r.locker.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	remote, err := r.Repo.Remote("origin")
+	if err != nil {
+		return nil, fmt.Errorf("create remote: %v", err)
+	}
+	refs, err := remote.List(&gogit.ListOptions{Auth: r.AuthMethod})
+	if err != nil {
+		return nil, fmt.Errorf("listing remote %v: %v", r.URI, err)
 	}
+	var names []string
+	for _, ref := range refs {
+		if match(ref.Name()) {
+			names = append(names, ref.Name().Short())
+		}
+	}
+	return names, nil
+}
 
-	if err = remote.Fetch(&gogit.FetchOptions{
+func (r *Repository) fetchOrigin(refSpecs ...config.RefSpec) error {
+	remote, err := r.Repo.Remote("origin")
+	if err != nil {
+		return fmt.Errorf("create remote: %v", err)
+	}
+	err = remote.Fetch(&gogit.FetchOptions{
 		RefSpecs: refSpecs,
 		Auth:     r.AuthMethod,
-	}); err != nil {
-		if err == gogit.NoErrAlreadyUpToDate {
-			fmt.Print("refs already up to date")
-		} else {
-			return fmt.Errorf("fetch origin failed: %v", err)
-		}
+		Prune:    true,
+	})
+	if err != nil && !errors.Is(err, gogit.NoErrAlreadyUpToDate) {
+		return fmt.Errorf("fetch origin failed: %v", err)
 	}
-
 	return nil
 }
+
+// knownHostsCallback returns a host key callback verifying host keys
+// against known_hosts content
+func knownHostsCallback(knownHosts string) (gossh.HostKeyCallback, error) {
+	f, err := os.CreateTemp("", "known_hosts")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(knownHosts)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The file is parsed when creating the callback
+	return ssh.NewKnownHostsCallback(f.Name())
+}
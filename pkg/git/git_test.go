@@ -0,0 +1,111 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package git
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/krm-functions/catalog/pkg/git/gittest"
+	a "github.com/stretchr/testify/assert"
+)
+
+func TestMirror(t *testing.T) {
+	upstreamDir := t.TempDir()
+	upstream, err := gogit.PlainInitWithOptions(upstreamDir, &gogit.PlainInitOptions{
+		InitOptions: gogit.InitOptions{DefaultBranch: plumbing.NewBranchReferenceName("main")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := gittest.CommitFiles(t, upstream, upstreamDir, map[string]string{"pkg1/cm.yaml": "v1", "README.md": "readme"})
+	if _, err = upstream.CreateTag("v1.0", plumbing.NewHash(first), nil); err != nil {
+		t.Fatal(err)
+	}
+	second := gittest.CommitFiles(t, upstream, upstreamDir, map[string]string{"pkg1/cm.yaml": "v2"})
+
+	cacheDir := t.TempDir()
+	r, err := Mirror(upstreamDir, "", "", "", "", cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := t.TempDir()
+	hash, err := r.ExtractTree("HEAD", filepath.Join(base, "head"))
+	a.NoError(t, err)
+	a.Equal(t, second, hash)
+	b, err := os.ReadFile(filepath.Join(base, "head", "pkg1", "cm.yaml"))
+	a.NoError(t, err)
+	a.Equal(t, "v2", string(b))
+	b, err = os.ReadFile(filepath.Join(base, "head", "README.md"))
+	a.NoError(t, err)
+	a.Equal(t, "readme", string(b))
+
+	// Tags and earlier commits
+	hash, err = r.ResolveRevision("v1.0")
+	a.NoError(t, err)
+	a.Equal(t, first, hash)
+	_, err = r.ExtractTree(first, filepath.Join(base, "first"))
+	a.NoError(t, err)
+	b, err = os.ReadFile(filepath.Join(base, "first", "pkg1", "cm.yaml"))
+	a.NoError(t, err)
+	a.Equal(t, "v1", string(b))
+
+	// Commits unknown to the mirror are fetched
+	third := gittest.CommitFiles(t, upstream, upstreamDir, map[string]string{"pkg1/cm.yaml": "v3"})
+	hash, err = r.ResolveRevision(third)
+	a.NoError(t, err)
+	a.Equal(t, third, hash)
+	_, err = r.ResolveRevision("unknown")
+	a.Error(t, err)
+
+	// Existing mirrors are updated
+	fourth := gittest.CommitFiles(t, upstream, upstreamDir, map[string]string{"pkg1/cm.yaml": "v4"})
+	r, err = Mirror(upstreamDir, "", "", "", "", cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err = r.ResolveRevision("main")
+	a.NoError(t, err)
+	a.Equal(t, fourth, hash)
+}
+
+func TestPruneMirrors(t *testing.T) {
+	upstreamDir := t.TempDir()
+	upstream, err := gogit.PlainInit(upstreamDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gittest.CommitFiles(t, upstream, upstreamDir, map[string]string{"cm.yaml": "v1"})
+	cacheDir := t.TempDir()
+	if _, err = Mirror(upstreamDir, "", "", "", "", cacheDir); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := PruneMirrors(cacheDir, time.Hour)
+	a.NoError(t, err)
+	a.Empty(t, removed)
+
+	lastUsed := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(filepath.Join(mirrorPath(cacheDir, upstreamDir), mirrorUsedFile), lastUsed, lastUsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, err = PruneMirrors(cacheDir, time.Hour)
+	a.NoError(t, err)
+	a.Equal(t, []string{upstreamDir}, removed)
+	a.NoDirExists(t, mirrorPath(cacheDir, upstreamDir))
+}
@@ -0,0 +1,48 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package git
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func TestLockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mirror.lock")
+	f, err := lockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Locks are held per open file, such that a second open blocks like in another process
+	locked := make(chan struct{})
+	go func() {
+		f2, err := lockFile(path)
+		a.NoError(t, err)
+		close(locked)
+		f2.Close()
+	}()
+	select {
+	case <-locked:
+		t.Fatal("file locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	f.Close()
+	<-locked
+}
@@ -0,0 +1,91 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm
+
+import (
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/krm-functions/catalog/pkg/util"
+)
+
+var apiVersionRegexp = regexp.MustCompile(`^v[0-9]+((alpha|beta)[0-9]+)?$`)
+
+// Kubeconform standalone schemas only hold the first component of the
+// group name, e.g. 'deployment-apps-v1.json'
+var standaloneSchemaGroups = map[string]string{
+	"admissionregistration": "admissionregistration.k8s.io",
+	"apiextensions":         "apiextensions.k8s.io",
+	"apps":                  "apps",
+	"autoscaling":           "autoscaling",
+	"batch":                 "batch",
+	"certificates":          "certificates.k8s.io",
+	"coordination":          "coordination.k8s.io",
+	"discovery":             "discovery.k8s.io",
+	"events":                "events.k8s.io",
+	"flowcontrol":           "flowcontrol.apiserver.k8s.io",
+	"networking":            "networking.k8s.io",
+	"node":                  "node.k8s.io",
+	"policy":                "policy",
+	"rbac":                  "rbac.authorization.k8s.io",
+	"scheduling":            "scheduling.k8s.io",
+	"storage":               "storage.k8s.io",
+}
+
+// APIVersionsFromSchemaBundle computes API group/versions from a
+// kubeconform schema bundle. Both standalone Kubernetes schemas
+// ('<version>-standalone/<kind>-<group>-<version>.json') and CRD
+// catalog schemas ('<group>/<kind>_<version>.json') are supported
+func APIVersionsFromSchemaBundle(dir string) ([]string, error) {
+	var apiVersions []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), ".json") {
+			return nil
+		}
+		name := strings.TrimSuffix(d.Name(), ".json")
+		parent := filepath.Base(filepath.Dir(path))
+		switch {
+		case strings.Contains(parent, "-standalone"):
+			parts := strings.Split(name, "-")
+			ver := parts[len(parts)-1]
+			if !apiVersionRegexp.MatchString(ver) {
+				return nil
+			}
+			switch len(parts) {
+			case 2:
+				apiVersions = append(apiVersions, ver)
+			case 3:
+				if group, found := standaloneSchemaGroups[parts[1]]; found {
+					apiVersions = append(apiVersions, group+"/"+ver)
+				}
+			}
+		case strings.Contains(parent, "."):
+			_, ver, found := strings.Cut(name, "_")
+			if found && apiVersionRegexp.MatchString(ver) {
+				apiVersions = append(apiVersions, parent+"/"+ver)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return util.UniqueStrings(apiVersions), nil
+}
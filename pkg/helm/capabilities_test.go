@@ -0,0 +1,33 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIVersionsFromSchemaBundle(t *testing.T) {
+	apiVersions, err := APIVersionsFromSchemaBundle("../../examples/kubeconform/schema-bundle")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"external-secrets.io/v1beta1",
+		"gateway.networking.k8s.io/v1",
+		"karpenter.k8s.aws/v1beta1",
+		"karpenter.sh/v1beta1",
+		"v1",
+	}, apiVersions)
+}
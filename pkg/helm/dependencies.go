@@ -0,0 +1,280 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	t "github.com/krm-functions/catalog/pkg/helmspecs"
+	"github.com/krm-functions/catalog/pkg/semver"
+	kyaml "sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	chartMetadataFile = "Chart.yaml"
+	chartLockFile     = "Chart.lock"
+	chartDepsDir      = "charts"
+)
+
+// ChartDependency is a dependency as listed in 'Chart.yaml' or 'Chart.lock'
+type ChartDependency struct {
+	Name       string `json:"name,omitempty" yaml:"name,omitempty"`
+	Version    string `json:"version,omitempty" yaml:"version,omitempty"`
+	Repository string `json:"repository,omitempty" yaml:"repository,omitempty"`
+	Alias      string `json:"alias,omitempty" yaml:"alias,omitempty"`
+}
+
+func (d ChartDependency) String() string {
+	if d.Repository == "" {
+		return d.Name + "-" + d.Version
+	}
+	return d.Name + "-" + d.Version + " (" + d.Repository + ")"
+}
+
+// chartMetadata holds the subset of 'Chart.yaml' and 'Chart.lock' we need
+type chartMetadata struct {
+	Name         string            `json:"name,omitempty" yaml:"name,omitempty"`
+	Version      string            `json:"version,omitempty" yaml:"version,omitempty"`
+	Dependencies []ChartDependency `json:"dependencies,omitempty" yaml:"dependencies,omitempty"`
+	Digest       string            `json:"digest,omitempty" yaml:"digest,omitempty"`
+}
+
+// MissingDependenciesError is returned when a chart declares dependencies that are not vendored into the chart
+type MissingDependenciesError struct {
+	Chart   string
+	Missing []ChartDependency
+}
+
+func (e *MissingDependenciesError) Error() string {
+	deps := make([]string, 0, len(e.Missing))
+	for _, d := range e.Missing {
+		deps = append(deps, d.String())
+	}
+	return fmt.Sprintf("chart %v has missing dependencies: %v", e.Chart, strings.Join(deps, ", "))
+}
+
+// ChartDependencies returns the dependencies of an extracted chart. If
+// the chart has a 'Chart.lock' file, the locked dependencies are returned
+func ChartDependencies(chartDir string) ([]ChartDependency, error) {
+	lock, err := readChartMetadata(filepath.Join(chartDir, chartLockFile))
+	if err == nil {
+		return lock.Dependencies, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	meta, err := readChartMetadata(filepath.Join(chartDir, chartMetadataFile))
+	if err != nil {
+		return nil, err
+	}
+	return meta.Dependencies, nil
+}
+
+// MissingDependencies checks that all dependencies of an extracted
+// chart are available in the chart 'charts/' folder, either as
+// tarballs or as directories
+func MissingDependencies(chartDir string) ([]ChartDependency, error) {
+	deps, err := ChartDependencies(chartDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(deps) == 0 {
+		return nil, nil
+	}
+	vendored, err := vendoredCharts(filepath.Join(chartDir, chartDepsDir))
+	if err != nil {
+		return nil, err
+	}
+	var missing []ChartDependency
+	for _, d := range deps {
+		if !dependencySatisfied(d, vendored) {
+			missing = append(missing, d)
+		}
+	}
+	return missing, nil
+}
+
+// dependencySatisfied returns true if a vendored chart matches the
+// dependency name and version. Versions in 'Chart.yaml' may be
+// constraints, whereas versions in 'Chart.lock' are exact
+func dependencySatisfied(dep ChartDependency, vendored []chartMetadata) bool {
+	for _, v := range vendored {
+		if v.Name != dep.Name {
+			continue
+		}
+		if dep.Version == "" || v.Version == dep.Version {
+			return true
+		}
+		if _, err := semver.Upgrade([]string{v.Version}, dep.Version); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// vendoredCharts returns name and version of charts found in a chart 'charts/' folder
+func vendoredCharts(depsDir string) ([]chartMetadata, error) {
+	entries, err := os.ReadDir(depsDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var charts []chartMetadata
+	for _, e := range entries {
+		fname := filepath.Join(depsDir, e.Name())
+		switch {
+		case e.IsDir():
+			meta, err := readChartMetadata(filepath.Join(fname, chartMetadataFile))
+			if err != nil {
+				continue // Not a chart
+			}
+			charts = append(charts, *meta)
+		case strings.HasSuffix(e.Name(), ".tgz"):
+			buf, err := os.ReadFile(fname)
+			if err != nil {
+				return nil, err
+			}
+			meta, err := tarballChartMetadata(buf)
+			if err != nil {
+				return nil, fmt.Errorf("reading vendored chart %v: %w", e.Name(), err)
+			}
+			charts = append(charts, *meta)
+		}
+	}
+	return charts, nil
+}
+
+// tarballChartMetadata reads the top-level 'Chart.yaml' from a chart tarball
+func tarballChartMetadata(chartTarball []byte) (*chartMetadata, error) {
+	gzr, err := gzip.NewReader(bytes.NewReader(chartTarball))
+	if err != nil {
+		return nil, err
+	}
+	defer gzr.Close()
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		parts := strings.Split(hdr.Name, "/")
+		if len(parts) != 2 || parts[1] != chartMetadataFile {
+			continue
+		}
+		buf, err := io.ReadAll(io.LimitReader(tr, maxChartTemplateFileLength))
+		if err != nil {
+			return nil, err
+		}
+		return parseChartMetadata(buf)
+	}
+	return nil, fmt.Errorf("no %v found in chart", chartMetadataFile)
+}
+
+func readChartMetadata(fname string) (*chartMetadata, error) {
+	buf, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	return parseChartMetadata(buf)
+}
+
+func parseChartMetadata(buf []byte) (*chartMetadata, error) {
+	meta := &chartMetadata{}
+	if err := kyaml.Unmarshal(buf, meta); err != nil {
+		return nil, fmt.Errorf("parsing chart metadata: %w", err)
+	}
+	return meta, nil
+}
+
+// VendorDependencies resolves the dependencies of a chart into the
+// chart 'charts/' folder and returns the re-packaged chart
+// tarball. If the chart has a 'Chart.lock' file, dependencies are
+// resolved with 'helm dependency build', which verifies the lock
+// against 'Chart.yaml'. Otherwise dependencies are resolved with 'helm
+// dependency update'. Charts without dependencies are returned as-is
+func VendorDependencies(chart *t.HelmChartArgs, chartTarball []byte, username, password *string) ([]byte, error) {
+	tmpDir, err := os.MkdirTemp("", "chart-deps-")
+	if err != nil {
+		return nil, fmt.Errorf("creating tmp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	srcDir := filepath.Join(tmpDir, "src")
+	err = ExtractChart(chartTarball, srcDir)
+	if err != nil {
+		return nil, fmt.Errorf("extracting chart: %w", err)
+	}
+	chartDir := filepath.Join(srcDir, chart.Name)
+	missing, err := MissingDependencies(chartDir)
+	if err != nil {
+		return nil, fmt.Errorf("reading chart dependencies: %w", err)
+	}
+	if len(missing) == 0 {
+		return chartTarball, nil
+	}
+
+	helmCtxt := NewRunContext()
+	defer helmCtxt.DiscardContext()
+
+	// Dependency repositories must be known by Helm, OCI repositories are used directly
+	for idx, d := range missing {
+		if d.Repository == "" || isOciRepoURL(d.Repository) || strings.HasPrefix(d.Repository, "file://") {
+			continue
+		}
+		addArgs := []string{"repo", "add", fmt.Sprintf("deprepo%d", idx), d.Repository}
+		if d.Repository == chart.Repo && username != nil && password != nil && *username != "" {
+			addArgs = append(addArgs, "--username", *username, "--password", *password)
+		}
+		_, err = helmCtxt.Run(addArgs...)
+		if err != nil {
+			return nil, fmt.Errorf("adding dependency repo: %w", err)
+		}
+	}
+
+	depCmd := "update"
+	if _, err = os.Stat(filepath.Join(chartDir, chartLockFile)); err == nil {
+		depCmd = "build"
+	}
+	_, err = helmCtxt.Run("dependency", depCmd, chartDir)
+	if err != nil {
+		return nil, fmt.Errorf("resolving chart dependencies: %w", err)
+	}
+
+	pkgDir := filepath.Join(tmpDir, "pkg")
+	_, err = helmCtxt.Run("package", chartDir, "--destination", pkgDir)
+	if err != nil {
+		return nil, fmt.Errorf("packaging chart: %w", err)
+	}
+	pkgs, err := os.ReadDir(pkgDir)
+	if err != nil {
+		return nil, fmt.Errorf("read dir with chart tarball: %w", err)
+	}
+	if len(pkgs) != 1 {
+		return nil, fmt.Errorf("cannot determine packaged chart, found %d files", len(pkgs))
+	}
+	return os.ReadFile(filepath.Join(pkgDir, pkgs[0].Name()))
+}
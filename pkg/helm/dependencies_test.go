@@ -0,0 +1,68 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFile(t *testing.T, fname, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(fname), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fname, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMissingDependencies(t *testing.T) {
+	chartDir := t.TempDir()
+	writeFile(t, filepath.Join(chartDir, "Chart.yaml"), `apiVersion: v2
+name: parent
+version: 1.0.0
+dependencies:
+- name: common
+  version: "~2.1.0"
+  repository: https://charts.example.com
+- name: redis
+  version: "17.0.0"
+  repository: oci://registry.example.com/charts
+`)
+	writeFile(t, filepath.Join(chartDir, "charts", "common", "Chart.yaml"), `apiVersion: v2
+name: common
+version: 2.1.4
+`)
+
+	missing, err := MissingDependencies(chartDir)
+	assert.NoError(t, err)
+	assert.Equal(t, []ChartDependency{{Name: "redis", Version: "17.0.0", Repository: "oci://registry.example.com/charts"}}, missing)
+
+	// Chart.lock takes precedence and versions must match exactly
+	writeFile(t, filepath.Join(chartDir, "Chart.lock"), `dependencies:
+- name: common
+  version: 2.1.3
+  repository: https://charts.example.com
+digest: sha256:abc
+`)
+	missing, err = MissingDependencies(chartDir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(missing))
+	assert.Equal(t, "common-2.1.3 (https://charts.example.com)", missing[0].String())
+}
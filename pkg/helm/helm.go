@@ -204,7 +204,11 @@ func SourceChart(chart *t.HelmChartArgs, destination string, username, password
 }
 
 func isOciRepo(chart *t.HelmChartArgs) bool {
-	return strings.HasPrefix(chart.Repo, "oci://")
+	return isOciRepoURL(chart.Repo)
+}
+
+func isOciRepoURL(repo string) bool {
+	return strings.HasPrefix(repo, "oci://")
 }
 
 // chartTarballName returns the normalized tarball name 'name-v1.2.3.tgz'
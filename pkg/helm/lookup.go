@@ -0,0 +1,355 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
+	"github.com/krm-functions/catalog/pkg/api"
+	"sigs.k8s.io/kustomize/kyaml/kio/filters"
+	kyaml "sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+var fakeClusterKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: fake
+  cluster:
+    server: %s
+contexts:
+- name: fake
+  context:
+    cluster: fake
+    user: fake
+current-context: fake
+users:
+- name: fake
+  user: {}
+`
+
+// Version served by the fake cluster. Note, 'helm template' uses the
+// given '--kube-version' for chart capabilities, not the cluster version
+var fakeClusterVersion = map[string]string{
+	"major":      "1",
+	"minor":      "30",
+	"gitVersion": "v1.30.0",
+	"platform":   "linux/amd64",
+}
+
+// FakeCluster is a read-only, in-process Kubernetes API server
+// serving a fixed set of objects. It allows the Helm 'lookup'
+// function to return objects during 'helm template' without access to
+// a real cluster
+type FakeCluster struct {
+	server     *httptest.Server
+	tmpDir     string
+	kubeconfig string
+	// Objects indexed by group/version
+	objects map[string][]map[string]any
+}
+
+type fakeResource struct {
+	Name         string   `json:"name"`
+	SingularName string   `json:"singularName"`
+	Namespaced   bool     `json:"namespaced"`
+	Kind         string   `json:"kind"`
+	Verbs        []string `json:"verbs"`
+}
+
+// LookupObjects returns the objects of items annotated as lookup
+// objects. Lookup objects simulate existing cluster state and are
+// passed to the output of functions, hence they must be local-config
+// such that they are not applied with the package
+func LookupObjects(items fn.KubeObjects) (fn.KubeObjects, error) {
+	var objects fn.KubeObjects
+	for _, o := range items {
+		if o.GetAnnotation(api.HelmResourceAnnotationLookupObject) != "true" {
+			continue
+		}
+		if o.GetAnnotation(filters.LocalConfigAnnotation) != "true" {
+			return nil, fmt.Errorf("lookup object %v/%v must be annotated with %v: \"true\"",
+				o.GetKind(), o.GetName(), filters.LocalConfigAnnotation)
+		}
+		objects = append(objects, o)
+	}
+	return objects, nil
+}
+
+// NewFakeCluster starts a fake API server serving objects. The
+// server listens on the loopback interface only
+func NewFakeCluster(objects fn.KubeObjects) (*FakeCluster, error) {
+	c := &FakeCluster{objects: make(map[string][]map[string]any)}
+	for _, o := range objects {
+		obj, err := toClusterObject(o)
+		if err != nil {
+			return nil, fmt.Errorf("converting %v/%v: %w", o.GetKind(), o.GetName(), err)
+		}
+		gv := o.GetAPIVersion()
+		c.objects[gv] = append(c.objects[gv], obj)
+	}
+	tmpDir, err := os.MkdirTemp("", "fake-cluster-")
+	if err != nil {
+		return nil, err
+	}
+	c.tmpDir = tmpDir
+	c.server = httptest.NewServer(c)
+	c.kubeconfig = filepath.Join(tmpDir, "kubeconfig")
+	err = os.WriteFile(c.kubeconfig, []byte(fmt.Sprintf(fakeClusterKubeconfig, c.server.URL)), 0o600)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Kubeconfig returns the path of a kubeconfig file pointing to the fake cluster
+func (c *FakeCluster) Kubeconfig() string {
+	return c.kubeconfig
+}
+
+func (c *FakeCluster) Close() {
+	c.server.Close()
+	os.RemoveAll(c.tmpDir)
+}
+
+// toClusterObject converts an object to its JSON form, stripping
+// annotations that would not be present on objects in a cluster
+func toClusterObject(o *fn.KubeObject) (map[string]any, error) {
+	node, err := kyaml.Parse(o.String())
+	if err != nil {
+		return nil, err
+	}
+	for k := range node.GetAnnotations() {
+		if strings.HasPrefix(k, "config.kubernetes.io/") || strings.HasPrefix(k, "internal.config.kubernetes.io/") ||
+			k == api.HelmResourceAnnotationLookupObject {
+			if _, err = node.Pipe(kyaml.ClearAnnotation(k)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(node.GetAnnotations()) == 0 {
+		if err = node.PipeE(kyaml.Lookup("metadata"), kyaml.Clear("annotations")); err != nil {
+			return nil, err
+		}
+	}
+	b, err := node.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	obj := map[string]any{}
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (c *FakeCluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeStatus(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+		return
+	}
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	var gv string
+	var rest []string
+	switch {
+	case len(segments) == 1 && segments[0] == "version":
+		writeJSON(w, fakeClusterVersion)
+		return
+	case len(segments) == 1 && segments[0] == "api":
+		writeJSON(w, map[string]any{"kind": "APIVersions", "versions": []string{"v1"},
+			"serverAddressByClientCIDRs": []map[string]string{{"clientCIDR": "0.0.0.0/0", "serverAddress": r.Host}}})
+		return
+	case len(segments) == 1 && segments[0] == "apis":
+		writeJSON(w, map[string]any{"kind": "APIGroupList", "apiVersion": "v1", "groups": c.groups()})
+		return
+	case len(segments) == 2 && segments[0] == "apis":
+		for _, group := range c.groups() {
+			if group["name"] == segments[1] {
+				writeJSON(w, group)
+				return
+			}
+		}
+		writeStatus(w, http.StatusNotFound, "NotFound")
+		return
+	case len(segments) >= 2 && segments[0] == "api":
+		gv, rest = segments[1], segments[2:]
+	case len(segments) >= 3 && segments[0] == "apis":
+		gv, rest = segments[1]+"/"+segments[2], segments[3:]
+	default:
+		writeStatus(w, http.StatusNotFound, "NotFound")
+		return
+	}
+
+	resources := c.resources(gv)
+	var namespace, resource, name string
+	switch {
+	case len(rest) == 0:
+		writeJSON(w, map[string]any{"kind": "APIResourceList", "apiVersion": "v1", "groupVersion": gv, "resources": resources})
+		return
+	case len(rest) >= 3 && rest[0] == "namespaces":
+		namespace, resource = rest[1], rest[2]
+		if len(rest) > 3 {
+			name = rest[3]
+		}
+	default:
+		resource = rest[0]
+		if len(rest) > 1 {
+			name = rest[1]
+		}
+	}
+	var kind string
+	for _, res := range resources {
+		if res.Name == resource {
+			kind = res.Kind
+		}
+	}
+	if kind == "" {
+		writeStatus(w, http.StatusNotFound, "NotFound")
+		return
+	}
+
+	var items []map[string]any
+	for _, obj := range c.objects[gv] {
+		kObj, nsObj, nameObj := objectIdentity(obj)
+		if kObj != kind || (namespace != "" && nsObj != namespace) || (name != "" && nameObj != name) {
+			continue
+		}
+		items = append(items, obj)
+	}
+	if name != "" {
+		if len(items) == 0 {
+			writeStatus(w, http.StatusNotFound, "NotFound")
+			return
+		}
+		writeJSON(w, items[0])
+		return
+	}
+	if items == nil {
+		items = []map[string]any{}
+	}
+	writeJSON(w, map[string]any{"kind": kind + "List", "apiVersion": gv, "metadata": map[string]any{}, "items": items})
+}
+
+// groups returns the API groups of served objects
+func (c *FakeCluster) groups() []map[string]any {
+	versions := map[string][]string{}
+	for gv := range c.objects {
+		group, version, found := strings.Cut(gv, "/")
+		if !found {
+			continue // Core group
+		}
+		versions[group] = append(versions[group], version)
+	}
+	groups := []map[string]any{}
+	for _, group := range sortedKeys(versions) {
+		vers := versions[group]
+		sort.Strings(vers)
+		var gvs []map[string]string
+		for _, v := range vers {
+			gvs = append(gvs, map[string]string{"groupVersion": group + "/" + v, "version": v})
+		}
+		groups = append(groups, map[string]any{"kind": "APIGroup", "apiVersion": "v1", "name": group, "versions": gvs, "preferredVersion": gvs[0]})
+	}
+	return groups
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// resources returns the API resources for a group/version. Objects
+// with a namespace are considered namespaced. Unknown group/versions
+// return an empty list such that lookups return empty results
+func (c *FakeCluster) resources(gv string) []fakeResource {
+	resources := []fakeResource{}
+	for _, obj := range c.objects[gv] {
+		kind, namespace, _ := objectIdentity(obj)
+		found := false
+		for idx := range resources {
+			if resources[idx].Kind == kind {
+				resources[idx].Namespaced = resources[idx].Namespaced || namespace != ""
+				found = true
+			}
+		}
+		if !found {
+			resources = append(resources, fakeResource{
+				Name:         pluralResourceName(kind),
+				SingularName: strings.ToLower(kind),
+				Namespaced:   namespace != "",
+				Kind:         kind,
+				Verbs:        []string{"get", "list"},
+			})
+		}
+	}
+	return resources
+}
+
+func objectIdentity(obj map[string]any) (kind, namespace, name string) {
+	kind, _ = obj["kind"].(string)
+	if meta, ok := obj["metadata"].(map[string]any); ok {
+		namespace, _ = meta["namespace"].(string)
+		name, _ = meta["name"].(string)
+	}
+	return kind, namespace, name
+}
+
+// Kinds with resource names not following the English plural rules
+// of pluralResourceName
+var irregularResourceNames = map[string]string{
+	"Endpoints": "endpoints",
+}
+
+// pluralResourceName returns the resource name of a kind the same way
+// as most API servers, e.g. 'NetworkPolicy' -> 'networkpolicies'
+func pluralResourceName(kind string) string {
+	if name, found := irregularResourceNames[kind]; found {
+		return name
+	}
+	name := strings.ToLower(kind)
+	switch {
+	case strings.HasSuffix(name, "s"), strings.HasSuffix(name, "x"), strings.HasSuffix(name, "ch"), strings.HasSuffix(name, "sh"):
+		return name + "es"
+	case strings.HasSuffix(name, "y") && !strings.HasSuffix(name, "ay") && !strings.HasSuffix(name, "ey") && !strings.HasSuffix(name, "oy"):
+		return strings.TrimSuffix(name, "y") + "ies"
+	}
+	return name + "s"
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeStatus(w http.ResponseWriter, code int, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"kind": "Status", "apiVersion": "v1", "metadata": map[string]any{},
+		"status": "Failure", "reason": reason, "code": code,
+	})
+}
@@ -0,0 +1,142 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
+	"github.com/stretchr/testify/assert"
+)
+
+func fakeClusterGet(t *testing.T, c *FakeCluster, path string) (int, map[string]any) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, http.NoBody))
+	body := map[string]any{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, body
+}
+
+func TestFakeCluster(t *testing.T) {
+	objs, err := fn.ParseKubeObjects([]byte(`apiVersion: v1
+kind: Secret
+metadata:
+  name: my-secret
+  namespace: foo
+  annotations:
+    experimental.helm.sh/lookup-object: "true"
+    config.kubernetes.io/local-config: "true"
+data:
+  password: c2VjcmV0
+---
+apiVersion: networking.k8s.io/v1
+kind: NetworkPolicy
+metadata:
+  name: deny-all
+  namespace: foo
+  annotations:
+    experimental.helm.sh/lookup-object: "true"
+spec: {}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewFakeCluster(objs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	code, body := fakeClusterGet(t, c, "/api/v1/namespaces/foo/secrets/my-secret")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]any{"password": "c2VjcmV0"}, body["data"])
+	assert.Nil(t, body["metadata"].(map[string]any)["annotations"])
+
+	code, body = fakeClusterGet(t, c, "/api/v1/namespaces/bar/secrets/my-secret")
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, "NotFound", body["reason"])
+
+	code, body = fakeClusterGet(t, c, "/apis/networking.k8s.io/v1/namespaces/foo/networkpolicies")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "NetworkPolicyList", body["kind"])
+	assert.Equal(t, 1, len(body["items"].([]any)))
+
+	code, body = fakeClusterGet(t, c, "/apis/networking.k8s.io/v1")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "networkpolicies", body["resources"].([]any)[0].(map[string]any)["name"])
+
+	code, body = fakeClusterGet(t, c, "/apis/networking.k8s.io")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "networking.k8s.io/v1", body["preferredVersion"].(map[string]any)["groupVersion"])
+
+	code, body = fakeClusterGet(t, c, "/apis")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, len(body["groups"].([]any)))
+
+	code, body = fakeClusterGet(t, c, "/version")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "v1.30.0", body["gitVersion"])
+
+	// Unknown group/versions have no resources
+	code, body = fakeClusterGet(t, c, "/apis/example.com/v1")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 0, len(body["resources"].([]any)))
+}
+
+func TestLookupObjects(t *testing.T) {
+	objs, err := fn.ParseKubeObjects([]byte(`apiVersion: v1
+kind: Secret
+metadata:
+  name: my-secret
+  annotations:
+    experimental.helm.sh/lookup-object: "true"
+    config.kubernetes.io/local-config: "true"
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: not-a-lookup-object
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookupObjects, err := LookupObjects(objs)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(lookupObjects))
+	assert.Equal(t, "my-secret", lookupObjects[0].GetName())
+
+	// Lookup objects would otherwise be applied with the package
+	_, _ = objs[0].RemoveNestedField("metadata", "annotations", "config.kubernetes.io/local-config")
+	_, err = LookupObjects(objs)
+	assert.ErrorContains(t, err, "lookup object Secret/my-secret must be annotated")
+}
+
+func TestPluralResourceName(t *testing.T) {
+	for kind, name := range map[string]string{
+		"ConfigMap":     "configmaps",
+		"Endpoints":     "endpoints",
+		"Ingress":       "ingresses",
+		"NetworkPolicy": "networkpolicies",
+		"Gateway":       "gateways",
+	} {
+		assert.Equal(t, name, pluralResourceName(kind))
+	}
+}
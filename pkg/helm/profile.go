@@ -0,0 +1,89 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
+	"github.com/krm-functions/catalog/pkg/api"
+	t "github.com/krm-functions/catalog/pkg/helmspecs"
+	"github.com/krm-functions/catalog/pkg/util"
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
+)
+
+// ClusterProfileFromObjects returns the ClusterProfile of items, or
+// nil if there is none. At most one ClusterProfile is allowed. API
+// versions from the schema bundle, if given, are added to the profile
+func ClusterProfileFromObjects(items fn.KubeObjects) (*t.ClusterProfile, error) {
+	var profile *t.ClusterProfile
+	for _, kubeObject := range items {
+		if !kubeObject.IsGVK(api.HelmResourceAPI, "", "ClusterProfile") {
+			continue
+		}
+		if profile != nil {
+			return nil, fmt.Errorf("only one ClusterProfile supported, found %s", kubeObject.GetName())
+		}
+		var err error
+		profile, err = parseClusterProfile(kubeObject)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return profile, nil
+}
+
+// parseClusterProfile parses a ClusterProfile and adds API versions
+// from the schema bundle, if given
+func parseClusterProfile(kubeObject *fn.KubeObject) (*t.ClusterProfile, error) {
+	profile, err := t.ParseClusterProfile([]byte(kubeObject.String()))
+	if err != nil {
+		return nil, fmt.Errorf("parsing ClusterProfile %s: %w", kubeObject.GetName(), err)
+	}
+	if profile.Spec.SchemaBundle != "" {
+		schemaBundle, err := packagePath(kubeObject, profile.Spec.SchemaBundle)
+		if err != nil {
+			return nil, fmt.Errorf("schema bundle of ClusterProfile %s: %w", kubeObject.GetName(), err)
+		}
+		// Package files are not part of the ResourceList, i.e. the bundle
+		// is only available when the function runs in the package root
+		if _, err = os.Stat(schemaBundle); err != nil {
+			return nil, fmt.Errorf("schema bundle of ClusterProfile %s not found: %w (schemaBundle requires running the function with --exec from the package root)",
+				kubeObject.GetName(), err)
+		}
+		apiVersions, err := APIVersionsFromSchemaBundle(schemaBundle)
+		if err != nil {
+			return nil, fmt.Errorf("reading schema bundle of ClusterProfile %s: %w", kubeObject.GetName(), err)
+		}
+		profile.Spec.APIVersions = util.UniqueStrings(append(profile.Spec.APIVersions, apiVersions...))
+	}
+	return profile, nil
+}
+
+// packagePath resolves a path relative to the directory of a resource
+// in the package, i.e. to a path relative to the package root. Absolute
+// paths and paths outside the package are rejected
+func packagePath(kubeObject *fn.KubeObject, p string) (string, error) {
+	if filepath.IsAbs(p) {
+		return "", fmt.Errorf("path %v must be relative to the package", p)
+	}
+	resolved := filepath.Join(filepath.Dir(kubeObject.GetAnnotation(kioutil.PathAnnotation)), p)
+	if !filepath.IsLocal(resolved) {
+		return "", fmt.Errorf("path %v is outside the package", p)
+	}
+	return resolved, nil
+}
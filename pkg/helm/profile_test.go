@@ -0,0 +1,86 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
+	"github.com/stretchr/testify/assert"
+)
+
+func clusterProfileObject(t *testing.T, schemaBundle string) *fn.KubeObject {
+	o, err := fn.ParseKubeObject([]byte(`apiVersion: experimental.helm.sh/v1alpha1
+kind: ClusterProfile
+metadata:
+  name: profile
+  annotations:
+    internal.config.kubernetes.io/path: profiles/profile.yaml
+spec:
+  kubeVersion: 1.30.0
+  apiVersions:
+  - monitoring.coreos.com/v1
+  schemaBundle: ` + schemaBundle + `
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func TestPackagePath(t *testing.T) {
+	o := clusterProfileObject(t, "schema-bundle")
+	p, err := packagePath(o, "schema-bundle")
+	assert.NoError(t, err)
+	assert.Equal(t, "profiles/schema-bundle", p)
+	p, err = packagePath(o, "../schema-bundle")
+	assert.NoError(t, err)
+	assert.Equal(t, "schema-bundle", p)
+	_, err = packagePath(o, "../../schema-bundle")
+	assert.ErrorContains(t, err, "outside the package")
+	_, err = packagePath(o, "/schema-bundle")
+	assert.ErrorContains(t, err, "must be relative")
+}
+
+func TestClusterProfileFromObjects(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgDir := t.TempDir()
+	writeFile(t, filepath.Join(pkgDir, "profiles/schema-bundle/master-standalone-strict/deployment-apps-v1.json"), "{}")
+	if err = os.Chdir(pkgDir); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chdir(wd) }()
+
+	profile, err := ClusterProfileFromObjects(fn.KubeObjects{clusterProfileObject(t, "schema-bundle")})
+	assert.NoError(t, err)
+	assert.Equal(t, "1.30.0", profile.Spec.KubeVersion)
+	assert.Equal(t, []string{"apps/v1", "monitoring.coreos.com/v1"}, profile.Spec.APIVersions)
+
+	profile, err = ClusterProfileFromObjects(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, profile)
+
+	_, err = ClusterProfileFromObjects(fn.KubeObjects{clusterProfileObject(t, "schema-bundle"), clusterProfileObject(t, "schema-bundle")})
+	assert.ErrorContains(t, err, "only one ClusterProfile supported")
+
+	// Package files are not available, e.g. in a function container
+	_, err = ClusterProfileFromObjects(fn.KubeObjects{clusterProfileObject(t, "missing-bundle")})
+	assert.ErrorContains(t, err, "schemaBundle requires running the function with --exec")
+}
@@ -24,6 +24,8 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
@@ -40,8 +42,10 @@ const (
 // Template extracts a chart tarball and renders the chart using given
 // values and `helm template`. The raw chart tarball data is given in
 // `chartTarball` (note, not base64 encoded). Returns the rendered
-// text
-func Template(chart *t.HelmChart, chartTarball []byte) ([]byte, error) {
+// text. Charts with dependencies not vendored into the chart return a
+// MissingDependenciesError. If `cluster` is non-nil, the Helm
+// `lookup` function returns objects from the given fake cluster
+func Template(chart *t.HelmChart, chartTarball []byte, cluster *FakeCluster) ([]byte, error) {
 	tmpDir, err := os.MkdirTemp("", "chart-")
 	if err != nil {
 		return nil, err
@@ -52,6 +56,15 @@ func Template(chart *t.HelmChart, chartTarball []byte) ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("extracting chart: %w", err)
 	}
+	chartDir := filepath.Join(tmpDir, chart.Args.Name)
+
+	missing, err := MissingDependencies(chartDir)
+	if err != nil {
+		return nil, fmt.Errorf("reading chart dependencies: %w", err)
+	}
+	if len(missing) > 0 {
+		return nil, &MissingDependenciesError{Chart: chart.Args.Name, Missing: missing}
+	}
 
 	valuesFile := filepath.Join(tmpDir, "values.yaml")
 	err = writeValuesFile(chart, valuesFile)
@@ -59,7 +72,10 @@ func Template(chart *t.HelmChart, chartTarball []byte) ([]byte, error) {
 		return nil, fmt.Errorf("writing values file: %w", err)
 	}
 	args := buildHelmTemplateArgs(chart)
-	args = append(args, "--values", valuesFile, filepath.Join(tmpDir, chart.Args.Name))
+	args = append(args, "--values", valuesFile, chartDir)
+	if cluster != nil {
+		args = append(args, "--dry-run=server", "--kubeconfig", cluster.Kubeconfig())
+	}
 
 	helmCtxt := NewRunContext()
 	defer helmCtxt.DiscardContext()
@@ -117,30 +133,140 @@ func ExtractChart(chartTarball []byte, destDir string) error {
 	return nil
 }
 
-func ParseAsKubeObjects(rendered []byte) (fn.KubeObjects, error) {
-	r := &kio.ByteReader{Reader: bytes.NewBufferString(string(rendered)), OmitReaderAnnotations: true}
+// ParseAsKubeObjects parses the rendered output of a chart. Documents
+// without objects, e.g. from templates rendering to nothing, are
+// skipped and summarized in the returned results. Malformed documents
+// fail parsing in strict mode, and are skipped with a warning result in
+// lenient mode. Results reference the chart template through the
+// `# Source:` comment added by Helm in the message and the 'source' and
+// 'line' tags, since the template is not a file of the package
+func ParseAsKubeObjects(rendered []byte, strict bool) (fn.KubeObjects, fn.Results, error) {
+	var objects fn.KubeObjects
+	var results fn.Results
+	var skipped []string
+	for _, doc := range splitRenderedDocuments(rendered) {
+		docObjects, err := doc.parse()
+		if err == nil {
+			if len(docObjects) == 0 && doc.source != "" {
+				skipped = append(skipped, doc.source)
+			}
+			objects = append(objects, docObjects...)
+			continue
+		}
+		msg := doc.errorMessage(err)
+		if strict {
+			results = append(results, &fn.Result{Message: msg, Severity: fn.Error, Tags: doc.errorTags(err)})
+			return nil, results, fmt.Errorf("failed to parse rendered document: %s", msg)
+		}
+		results = append(results, &fn.Result{Message: "skipped malformed document: " + msg, Severity: fn.Warning, Tags: doc.errorTags(err)})
+	}
+	if len(skipped) > 0 {
+		results = append(results, &fn.Result{
+			Message:  fmt.Sprintf("skipped %d empty documents: %s", len(skipped), strings.Join(skipped, ", ")),
+			Severity: fn.Info,
+		})
+	}
+	return objects, results, nil
+}
+
+// renderedDocument is a single YAML document from rendered chart output
+type renderedDocument struct {
+	content string
+	// Chart template from the `# Source:` comment, e.g. 'chart/templates/deployment.yaml'
+	source string
+	// Line of the `# Source:` comment within the document
+	sourceLine int
+}
+
+var yamlErrorLineRegexp = regexp.MustCompile(`line ([0-9]+)`)
+
+// parse parses the objects of a document. Lists are unwrapped into
+// their items and documents without objects return no objects
+func (doc *renderedDocument) parse() (fn.KubeObjects, error) {
+	r := &kio.ByteReader{Reader: bytes.NewBufferString(doc.content), OmitReaderAnnotations: true}
 	nodes, err := r.Read()
 	if err != nil {
 		return nil, err
 	}
-
 	var objects fn.KubeObjects
 	for i := range nodes {
-		o, parseErr := fn.ParseKubeObject([]byte(nodes[i].MustString()))
-		if parseErr != nil {
-			if strings.Contains(parseErr.Error(), "expected exactly one object, got 0") {
+		o, err := fn.ParseKubeObject([]byte(nodes[i].MustString()))
+		if err != nil {
+			if strings.Contains(err.Error(), "expected exactly one object, got 0") {
 				continue
 			}
-			return nil, fmt.Errorf("failed to parse %s: %s", nodes[i].MustString(), parseErr.Error())
+			return nil, err
 		}
 		objects = append(objects, o)
 	}
+	return objects, nil
+}
 
-	if err != nil {
-		return nil, err
+// errorMessage formats a parse error with the template source. Lines
+// are lines of the rendered output of the template, counted from the
+// `# Source:` comment, and not lines of the template source, since
+// Helm does not map rendered output back to template lines
+func (doc *renderedDocument) errorMessage(err error) string {
+	source := doc.source
+	if source == "" {
+		source = "<unknown source>"
 	}
+	if line, found := doc.errorLine(err); found {
+		return fmt.Sprintf("%s: line %d of rendered output: %s", source, line, err)
+	}
+	return fmt.Sprintf("%s: %s", source, err)
+}
 
-	return objects, nil
+// errorTags returns result tags with the template source and line of
+// rendered output of a parse error, where known
+func (doc *renderedDocument) errorTags(err error) map[string]string {
+	tags := map[string]string{}
+	if doc.source != "" {
+		tags["source"] = doc.source
+	}
+	if line, found := doc.errorLine(err); found {
+		tags["line"] = strconv.Itoa(line)
+	}
+	return tags
+}
+
+// errorLine returns the line of a parse error, counted from the
+// `# Source:` comment
+func (doc *renderedDocument) errorLine(err error) (int, bool) {
+	m := yamlErrorLineRegexp.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0, false
+	}
+	line, _ := strconv.Atoi(m[1])
+	return line - doc.sourceLine, true
+}
+
+// splitRenderedDocuments splits rendered chart output into YAML documents
+func splitRenderedDocuments(rendered []byte) []renderedDocument {
+	var docs []renderedDocument
+	var curr renderedDocument
+	var lines []string
+	flush := func() {
+		curr.content = strings.Join(lines, "\n")
+		if strings.TrimSpace(curr.content) != "" {
+			docs = append(docs, curr)
+		}
+		curr = renderedDocument{}
+		lines = nil
+	}
+	for _, line := range strings.Split(string(rendered), "\n") {
+		if line == "---" || strings.HasPrefix(line, "--- ") {
+			flush()
+			continue
+		}
+		lines = append(lines, line)
+		if curr.source == "" && strings.HasPrefix(line, "# Source: ") {
+			curr.source = strings.TrimSpace(strings.TrimPrefix(line, "# Source: "))
+			curr.sourceLine = len(lines)
+		}
+	}
+	flush()
+	return docs
 }
 
 func ParseAsRNodes(rendered []byte) ([]*kyaml.RNode, error) {
@@ -0,0 +1,160 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
+	"github.com/krm-functions/catalog/pkg/helmspecs"
+	"github.com/stretchr/testify/assert"
+)
+
+var renderedChart = `---
+# Source: test-chart/templates/empty.yaml
+# Nothing rendered here
+---
+# Source: test-chart/templates/configmap.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+data:
+  foo: bar
+---
+# Source: test-chart/templates/list.yaml
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: item1
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: item2
+---
+# Source: test-chart/templates/broken.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: broken
+data:
+  foo: bar
+   baz: olo
+`
+
+func TestParseAsKubeObjects(t *testing.T) {
+	_, results, err := ParseAsKubeObjects([]byte(renderedChart), true)
+	assert.Error(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, fn.Error, results[0].Severity)
+	assert.Nil(t, results[0].File) // Chart templates are not package files
+	assert.Equal(t, map[string]string{"source": "test-chart/templates/broken.yaml", "line": "7"}, results[0].Tags)
+	assert.Contains(t, results[0].Message, "test-chart/templates/broken.yaml: line 7 of rendered output")
+
+	objs, results, err := ParseAsKubeObjects([]byte(renderedChart), false)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(objs))
+	assert.Equal(t, "foo", objs[0].GetName())
+	assert.Equal(t, "item1", objs[1].GetName())
+	assert.Equal(t, "item2", objs[2].GetName())
+	assert.Equal(t, 2, len(results))
+	assert.Equal(t, fn.Warning, results[0].Severity)
+	assert.Equal(t, "skipped 1 empty documents: test-chart/templates/empty.yaml", results[1].Message)
+}
+
+// chartTarball packages the chart in dir like 'helm package'
+func chartTarball(t *testing.T, dir string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(filepath.Dir(dir), path)
+		if err != nil {
+			return err
+		}
+		if err = tw.WriteHeader(&tar.Header{Name: filepath.ToSlash(rel), Mode: 0o644, Size: int64(len(b)), Typeflag: tar.TypeReg}); err != nil {
+			return err
+		}
+		_, err = tw.Write(b)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTemplateLookup(t *testing.T) {
+	if _, err := exec.LookPath("helm"); err != nil {
+		t.Skip("helm not installed")
+	}
+	b, err := os.ReadFile("../../test-data/lookup-objects.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	objs, err := fn.ParseKubeObjects(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster, err := NewFakeCluster(objs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+	tarball := chartTarball(t, "../../test-data/test-chart")
+	chart := &helmspecs.HelmChart{
+		Args:    helmspecs.HelmChartArgs{Name: "test-chart"},
+		Options: helmspecs.HelmTemplateOptions{ReleaseName: "test-chart-rel", Namespace: "default"},
+	}
+
+	rendered, err := Template(chart, tarball, cluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(rendered), `configMapValue: "from-cluster"`)
+	assert.Contains(t, string(rendered), `endpointsName: "lookup-endpoints"`)
+
+	// Without a cluster, lookup returns empty objects
+	rendered, err = Template(chart, tarball, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(rendered), `configMapValue: "not-found"`)
+	assert.Contains(t, string(rendered), `endpointsName: "not-found"`)
+}
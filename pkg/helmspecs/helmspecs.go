@@ -16,10 +16,16 @@ package helmspecs
 
 import (
 	"fmt"
+	"slices"
 
 	kyaml "sigs.k8s.io/kustomize/kyaml/yaml"
 )
 
+const (
+	ParseModeStrict  = "strict"
+	ParseModeLenient = "lenient"
+)
+
 // Kpt Helm related types
 type HelmChart struct {
 	Args    HelmChartArgs       `json:"chartArgs,omitempty" yaml:"chartArgs,omitempty"`
@@ -33,6 +39,8 @@ type HelmChartArgs struct {
 	Repo     string                    `json:"repo,omitempty" yaml:"repo,omitempty"`
 	Registry string                    `json:"registry,omitempty" yaml:"registry,omitempty"`
 	Auth     *kyaml.ResourceIdentifier `json:"auth,omitempty" yaml:"auth,omitempty"`
+	// Resolve chart dependencies into the embedded chart when sourcing
+	VendorDependencies bool `json:"vendorDependencies,omitempty" yaml:"vendorDependencies,omitempty"`
 }
 type HelmTemplateOptions struct {
 	APIVersions  []string   `json:"apiVersions,omitempty" yaml:"apiVersions,omitempty"`
@@ -44,6 +52,16 @@ type HelmTemplateOptions struct {
 	IncludeCRDs  bool       `json:"includeCRDs,omitempty" yaml:"includeCRDs,omitempty"`
 	SkipTests    bool       `json:"skipTests,omitempty" yaml:"skipTests,omitempty"`
 	Values       HelmValues `json:"values,omitempty" yaml:"values,omitempty"`
+	// Parsing of rendered chart, 'strict' (default) or 'lenient'
+	ParseMode string `json:"parseMode,omitempty" yaml:"parseMode,omitempty"`
+	// Built-in functions applied to the rendered chart, in order
+	PostRenderers []PostRenderer `json:"postRenderers,omitempty" yaml:"postRenderers,omitempty"`
+}
+type PostRenderer struct {
+	// Name of built-in function, e.g. 'set-labels'
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	// Function config, similar to 'configMap' of Kptfile pipeline functions
+	ConfigMap map[string]string `json:"configMap,omitempty" yaml:"configMap,omitempty"`
 }
 type HelmValues struct {
 	ValuesFiles  []string       `json:"valuesFiles,omitempty" yaml:"valuesFiles,omitempty"`
@@ -57,6 +75,19 @@ type RenderHelmChart struct {
 	Charts []HelmChart `json:"helmCharts,omitempty" yaml:"helmCharts,omitempty"`
 }
 
+// ClusterProfile declares the capabilities of the cluster(s) charts
+// are rendered for. Used as defaults for chart template options
+type ClusterProfile struct {
+	Kind string             `json:"kind,omitempty" yaml:"kind,omitempty"`
+	Spec ClusterProfileSpec `json:"spec,omitempty" yaml:"spec,omitempty"`
+}
+type ClusterProfileSpec struct {
+	KubeVersion string   `json:"kubeVersion,omitempty" yaml:"kubeVersion,omitempty"`
+	APIVersions []string `json:"apiVersions,omitempty" yaml:"apiVersions,omitempty"`
+	// Path to a kubeconform schema bundle from which API versions are computed
+	SchemaBundle string `json:"schemaBundle,omitempty" yaml:"schemaBundle,omitempty"`
+}
+
 // ArgoCD Helm related types
 type ArgoCDHelmSource struct {
 	Name    string `json:"chart,omitempty" yaml:"chart,omitempty"`
@@ -92,6 +123,9 @@ func (spec *RenderHelmChart) IsValidSpec() error {
 			return fmt.Errorf("chart name, version or repo cannot be empty (%s,%s,%s)",
 				chart.Args.Name, chart.Args.Version, chart.Args.Repo)
 		}
+		if chart.Options.ParseMode != "" && chart.Options.ParseMode != ParseModeStrict && chart.Options.ParseMode != ParseModeLenient {
+			return fmt.Errorf("chart %s: unsupported parseMode: %s", chart.Args.Name, chart.Options.ParseMode)
+		}
 		if chart.Args.Auth != nil {
 			if chart.Args.Auth.Kind != "Secret" {
 				return fmt.Errorf("chart auth kind must be 'Secret'")
@@ -104,6 +138,30 @@ func (spec *RenderHelmChart) IsValidSpec() error {
 	return nil
 }
 
+func ParseClusterProfile(b []byte) (*ClusterProfile, error) {
+	profile := &ClusterProfile{}
+	if err := kyaml.Unmarshal(b, profile); err != nil {
+		return nil, err
+	}
+	if profile.Kind != "ClusterProfile" {
+		return nil, fmt.Errorf("unsupported kind: %s", profile.Kind)
+	}
+	return profile, nil
+}
+
+// ApplyDefaults sets chart capabilities from the cluster profile. The
+// chart kube version takes precedence and API versions are merged
+func (profile *ClusterProfile) ApplyDefaults(opts *HelmTemplateOptions) {
+	if opts.KubeVersion == "" {
+		opts.KubeVersion = profile.Spec.KubeVersion
+	}
+	for _, apiVer := range profile.Spec.APIVersions {
+		if !slices.Contains(opts.APIVersions, apiVer) {
+			opts.APIVersions = append(opts.APIVersions, apiVer)
+		}
+	}
+}
+
 func ParseArgoCDSpec(b []byte) (*ArgoCDHelmApp, error) {
 	app := &ArgoCDHelmApp{}
 	if err := kyaml.Unmarshal(b, app); err != nil {
@@ -20,6 +20,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"text/template"
 
@@ -39,7 +40,60 @@ data:
 {{- end }}
 `
 
-func UpdateKptMetadata(path, pkgName string, metadata map[string]string, gitDirectory, gitRepo, gitRev, gitHash string) error {
+// Kptfile annotations recording upstreams other than git, since the
+// Kptfile 'upstream' and 'upstreamLock' fields only support git and
+// kpt rejects unknown Kptfile fields
+const (
+	UpstreamTypeAnnotation      = "fn.kpt.dev/upstream-type"
+	UpstreamRepoAnnotation      = "fn.kpt.dev/upstream-repo"
+	UpstreamNameAnnotation      = "fn.kpt.dev/upstream-name"
+	UpstreamDirectoryAnnotation = "fn.kpt.dev/upstream-directory"
+	UpstreamRefAnnotation       = "fn.kpt.dev/upstream-ref"
+	UpstreamLockAnnotation      = "fn.kpt.dev/upstream-lock"
+)
+
+var upstreamAnnotations = []string{
+	UpstreamTypeAnnotation,
+	UpstreamRepoAnnotation,
+	UpstreamNameAnnotation,
+	UpstreamDirectoryAnnotation,
+	UpstreamRefAnnotation,
+	UpstreamLockAnnotation,
+}
+
+// Upstream is the source of a package. Git upstreams are recorded in
+// the Kptfile 'upstream' and 'upstreamLock' fields and other upstreams
+// with Kptfile annotations
+type Upstream struct {
+	Type string
+	// Git repository, OCI image repository or Helm chart repository
+	Repo string
+	// Helm chart name
+	Name      string
+	Directory string
+	// Ref as given, e.g. a branch or a semver constraint
+	Ref string
+	// Ref resolved from Ref, e.g. a tag resolved from a semver constraint
+	LockRef string
+	// Git commit, OCI image digest or Helm chart sum
+	Lock string
+}
+
+// GitUpstream returns upstream information for a package sourced from
+// git. The lock ref may differ from the upstream ref, e.g. a tag
+// resolved from a semver constraint
+func GitUpstream(repo, directory, ref, lockRef, hash string) *Upstream {
+	return &Upstream{
+		Type:      string(kptfile.GitOrigin),
+		Repo:      repo,
+		Directory: "/" + directory,
+		Ref:       ref,
+		LockRef:   lockRef,
+		Lock:      hash,
+	}
+}
+
+func UpdateKptMetadata(path, pkgName string, metadata map[string]string, upstream *Upstream) error {
 	fname := filepath.Join(path, "package-context.yaml")
 	data := map[string]any{
 		"Data": metadata,
@@ -65,31 +119,119 @@ func UpdateKptMetadata(path, pkgName string, metadata map[string]string, gitDire
 	// 'kpt kpg get' sets name to the name of the package create (to path) and removes namespace
 	kf.Name = pkgName
 	kf.Namespace = ""
-	// Set source
-	kf.Upstream = &kptfile.Upstream{
-		Type: "git",
-		Git: &kptfile.Git{
-			Repo:      gitRepo,
-			Directory: "/" + gitDirectory,
-			Ref:       gitRev,
-		},
-		UpdateStrategy: "resource-merge",
-	}
-	kf.UpstreamLock = &kptfile.UpstreamLock{
-		Type: "git",
-		Git: &kptfile.GitLock{
-			Repo:      gitRepo,
-			Directory: "/" + gitDirectory,
-			Ref:       gitRev,
-			Commit:    gitHash,
-		},
-	}
-
-	err = WriteKptfile(kfn, kf)
+	setUpstream(kf, upstream)
+
+	return WriteKptfile(kfn, kf)
+}
+
+// setUpstream sets the source of a Kptfile, replacing any previous source
+func setUpstream(kf *kptfile.KptFile, upstream *Upstream) {
+	kf.Upstream, kf.UpstreamLock = nil, nil
+	for _, anno := range upstreamAnnotations {
+		delete(kf.Annotations, anno)
+	}
+	if upstream.Type == string(kptfile.GitOrigin) {
+		kf.Upstream = &kptfile.Upstream{
+			Type: kptfile.GitOrigin,
+			Git: &kptfile.Git{
+				Repo:      upstream.Repo,
+				Directory: upstream.Directory,
+				Ref:       upstream.Ref,
+			},
+			UpdateStrategy: kptfile.ResourceMerge,
+		}
+		kf.UpstreamLock = &kptfile.UpstreamLock{
+			Type: kptfile.GitOrigin,
+			Git: &kptfile.GitLock{
+				Repo:      upstream.Repo,
+				Directory: upstream.Directory,
+				Ref:       upstream.LockRef,
+				Commit:    upstream.Lock,
+			},
+		}
+	} else {
+		if kf.Annotations == nil {
+			kf.Annotations = map[string]string{}
+		}
+		for anno, value := range map[string]string{
+			UpstreamTypeAnnotation:      upstream.Type,
+			UpstreamRepoAnnotation:      upstream.Repo,
+			UpstreamNameAnnotation:      upstream.Name,
+			UpstreamDirectoryAnnotation: upstream.Directory,
+			UpstreamRefAnnotation:       upstream.Ref,
+			UpstreamLockAnnotation:      upstream.Lock,
+		} {
+			if value != "" {
+				kf.Annotations[anno] = value
+			}
+		}
+	}
+	if len(kf.Annotations) == 0 {
+		kf.Annotations = nil
+	}
+}
+
+// AddPipelineFunctions adds mutators and validators to the pipeline of
+// the Kptfile in path. Functions of prepend are added before and
+// functions of appendFns after the existing functions. Existing
+// functions with the name of an added function are removed, i.e.
+// adding functions is idempotent
+func AddPipelineFunctions(path string, prepend, appendFns *kptfile.Pipeline) error {
+	filename := filepath.Join(path, kptfile.KptFileName)
+	node, err := yaml.ReadFile(filename)
 	if err != nil {
-		return err
+		return fmt.Errorf("reading %v: %v", filename, err)
+	}
+	lists := map[string][2][]kptfile.Function{
+		"mutators":   {prepend.Mutators, appendFns.Mutators},
+		"validators": {prepend.Validators, appendFns.Validators},
 	}
+	for _, field := range []string{"mutators", "validators"} {
+		pre, post := lists[field][0], lists[field][1]
+		if len(pre)+len(post) == 0 {
+			continue
+		}
+		added := map[string]bool{}
+		for _, f := range append(slices.Clone(pre), post...) {
+			added[f.Name] = true
+		}
+		var existing []*yaml.RNode
+		if fns, err := node.Pipe(yaml.Lookup("pipeline", field)); err == nil && fns != nil {
+			if existing, err = fns.Elements(); err != nil {
+				return fmt.Errorf("reading pipeline %v: %v", field, err)
+			}
+		}
+		seq := yaml.NewListRNode()
+		if err = appendFunctions(seq, pre); err != nil {
+			return err
+		}
+		for _, fn := range existing {
+			if name, err := fn.GetString("name"); err != nil || !added[name] {
+				seq.YNode().Content = append(seq.YNode().Content, fn.YNode())
+			}
+		}
+		if err = appendFunctions(seq, post); err != nil {
+			return err
+		}
+		if err = node.PipeE(yaml.LookupCreate(yaml.MappingNode, "pipeline"), yaml.SetField(field, seq)); err != nil {
+			return fmt.Errorf("setting pipeline %v: %v", field, err)
+		}
+	}
+	return yaml.WriteFile(node, filename)
+}
 
+func appendFunctions(seq *yaml.RNode, fns []kptfile.Function) error {
+	for idx := range fns {
+		b, err := yaml.Marshal(&fns[idx])
+		if err != nil {
+			return err
+		}
+		fn, err := yaml.Parse(string(b))
+		if err != nil {
+			return err
+		}
+		seq.YNode().Content = append(seq.YNode().Content, fn.YNode())
+	}
 	return nil
 }
 
@@ -0,0 +1,124 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Configuration of kubeconform validators shared by the kubeconform
+// function and the kubeconform post-renderer
+package kubeconform
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/krm-functions/catalog/pkg/util"
+	"github.com/yannh/kubeconform/pkg/validator"
+)
+
+const (
+	StringTrue  = "true"
+	StringFalse = "false"
+)
+
+var kubernetesVersionRe = regexp.MustCompile(`^[0-9]+\.[0-9]+\.[0-9]+$`)
+
+// Config holds the kubeconform arguments. All values are strings, since
+// they are given as ConfigMap data
+type Config struct {
+	KubernetesVersion    string `yaml:"kubernetes_version,omitempty" json:"kubernetes_version,omitempty"`
+	IgnoreMissingSchemas string `yaml:"ignore_missing_schemas,omitempty" json:"ignore_missing_schemas,omitempty"`
+	Strict               string `yaml:"strict,omitempty" json:"strict,omitempty"`
+	SchemaLocations      string `yaml:"schema_locations,omitempty" json:"schema_locations,omitempty"`
+	SkipKinds            string `yaml:"skip_kinds,omitempty" json:"skip_kinds,omitempty"`
+	RejectKinds          string `yaml:"reject_kinds,omitempty" json:"reject_kinds,omitempty"`
+	Debug                string `yaml:"debug,omitempty" json:"debug,omitempty"`
+}
+
+// ConfigFromMap returns the config given as ConfigMap data
+func ConfigFromMap(data map[string]string) *Config {
+	return &Config{
+		KubernetesVersion:    data["kubernetes_version"],
+		IgnoreMissingSchemas: data["ignore_missing_schemas"],
+		Strict:               data["strict"],
+		SchemaLocations:      data["schema_locations"],
+		SkipKinds:            data["skip_kinds"],
+		RejectKinds:          data["reject_kinds"],
+		Debug:                data["debug"],
+	}
+}
+
+// Default sets defaults for arguments not given. Schema locations
+// default to KUBECONFORM_SCHEMA_LOCATIONS
+func (c *Config) Default() {
+	if c.KubernetesVersion == "" {
+		c.KubernetesVersion = "master"
+	}
+	if c.IgnoreMissingSchemas == "" {
+		c.IgnoreMissingSchemas = StringFalse
+	}
+	if c.Strict == "" {
+		c.Strict = StringTrue
+	}
+	if c.SchemaLocations == "" {
+		c.SchemaLocations = os.Getenv("KUBECONFORM_SCHEMA_LOCATIONS")
+	}
+	if c.Debug == "" {
+		c.Debug = StringFalse
+	}
+}
+
+func (c *Config) Validate() error {
+	if c.KubernetesVersion != "master" && !kubernetesVersionRe.MatchString(c.KubernetesVersion) {
+		return fmt.Errorf("illegal 'kubernetes_version' argument: %s", c.KubernetesVersion)
+	}
+	if c.IgnoreMissingSchemas != StringTrue && c.IgnoreMissingSchemas != StringFalse {
+		return fmt.Errorf("illegal 'ignore_missing_schemas' argument: %s", c.IgnoreMissingSchemas)
+	}
+	if c.Strict != StringTrue && c.Strict != StringFalse {
+		return fmt.Errorf("illegal 'strict' argument: %s", c.Strict)
+	}
+	return nil
+}
+
+// NewValidator returns a validator for a defaulted and validated config
+func (c *Config) NewValidator() (validator.Validator, error) {
+	opts := validator.Opts{
+		Debug:                c.Debug == StringTrue,
+		KubernetesVersion:    c.KubernetesVersion,
+		Strict:               c.Strict == StringTrue,
+		IgnoreMissingSchemas: c.IgnoreMissingSchemas == StringTrue,
+	}
+	var schemas []string
+	if c.SchemaLocations != "" {
+		schemas = util.CsvToList(c.SchemaLocations)
+	}
+	if c.SkipKinds != "" {
+		opts.SkipKinds = csvToKindMap(c.SkipKinds)
+	}
+	if c.RejectKinds != "" {
+		opts.RejectKinds = csvToKindMap(c.RejectKinds)
+	}
+	v, err := validator.New(schemas, opts)
+	if err != nil {
+		return nil, fmt.Errorf("initializing validator: %w", err)
+	}
+	return v, nil
+}
+
+func csvToKindMap(cvs string) map[string]struct{} {
+	kinds := make(map[string]struct{})
+	for _, itm := range util.CsvToList(cvs) {
+		kinds[itm] = struct{}{}
+	}
+	return kinds
+}
@@ -0,0 +1,47 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package kubeconform
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig(tt *testing.T) {
+	tt.Setenv("KUBECONFORM_SCHEMA_LOCATIONS", "/schemas")
+	c := ConfigFromMap(map[string]string{"skip_kinds": "v1/ConfigMap"})
+	c.Default()
+	assert.NoError(tt, c.Validate())
+	assert.Equal(tt, &Config{
+		KubernetesVersion:    "master",
+		IgnoreMissingSchemas: StringFalse,
+		Strict:               StringTrue,
+		SchemaLocations:      "/schemas",
+		SkipKinds:            "v1/ConfigMap",
+		Debug:                StringFalse,
+	}, c)
+
+	c = ConfigFromMap(map[string]string{"kubernetes_version": "1.30.0"})
+	c.Default()
+	assert.NoError(tt, c.Validate())
+
+	c = ConfigFromMap(map[string]string{"kubernetes_version": "v1.30"})
+	c.Default()
+	assert.ErrorContains(tt, c.Validate(), "illegal 'kubernetes_version' argument: v1.30")
+
+	c = ConfigFromMap(map[string]string{"strict": "yes"})
+	c.Default()
+	assert.ErrorContains(tt, c.Validate(), "illegal 'strict' argument: yes")
+}
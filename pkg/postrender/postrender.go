@@ -0,0 +1,126 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Built-in functions that can be applied to rendered Helm charts
+package postrender
+
+import (
+	"fmt"
+
+	"github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
+	t "github.com/krm-functions/catalog/pkg/helmspecs"
+	kc "github.com/krm-functions/catalog/pkg/kubeconform"
+	"github.com/krm-functions/catalog/pkg/setannotations"
+	"github.com/krm-functions/catalog/pkg/setlabels"
+	"github.com/yannh/kubeconform/pkg/resource"
+	"github.com/yannh/kubeconform/pkg/validator"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	SetLabels      = "set-labels"
+	SetAnnotations = "set-annotations"
+	Kubeconform    = "kubeconform"
+)
+
+// Run applies post-renderers to objects in the given order
+func Run(renderers []t.PostRenderer, objects fn.KubeObjects) (fn.KubeObjects, fn.Results, error) {
+	var results fn.Results
+	for idx := range renderers {
+		r := &renderers[idx]
+		var err error
+		switch r.Name {
+		case SetLabels:
+			err = setLabels(r.ConfigMap, objects)
+		case SetAnnotations:
+			err = setAnnotations(r.ConfigMap, objects)
+		case Kubeconform:
+			var res fn.Results
+			res, err = kubeconform(r.ConfigMap, objects)
+			results = append(results, res...)
+		default:
+			err = fmt.Errorf("unknown post-renderer: %v", r.Name)
+		}
+		if err != nil {
+			return nil, results, fmt.Errorf("post-renderer %v: %w", r.Name, err)
+		}
+	}
+	return objects, results, nil
+}
+
+// setLabels sets labels like the set-labels function
+func setLabels(labels map[string]string, objects fn.KubeObjects) error {
+	return applyFilter(&setlabels.SetLabels{Labels: labels}, objects)
+}
+
+// setAnnotations sets annotations like the set-annotations function
+func setAnnotations(annotations map[string]string, objects fn.KubeObjects) error {
+	return applyFilter(&setannotations.SetAnnotations{Annotations: annotations}, objects)
+}
+
+// applyFilter applies a function filter to objects in place
+func applyFilter(filter yaml.Filter, objects fn.KubeObjects) error {
+	for _, o := range objects {
+		node, err := yaml.Parse(o.String())
+		if err != nil {
+			return err
+		}
+		if err = node.PipeE(filter); err != nil {
+			return err
+		}
+		updated, err := fn.ParseKubeObject([]byte(node.MustString()))
+		if err != nil {
+			return err
+		}
+		*o = *updated
+	}
+	return nil
+}
+
+// kubeconform validates objects. The config keys are identical to the
+// kubeconform function config
+func kubeconform(config map[string]string, objects fn.KubeObjects) (fn.Results, error) {
+	var results fn.Results
+	cfg := kc.ConfigFromMap(config)
+	cfg.Default()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	v, err := cfg.NewValidator()
+	if err != nil {
+		return nil, err
+	}
+
+	var invalid int
+	for _, o := range objects {
+		r := v.ValidateResource(resource.Resource{Bytes: []byte(o.String())})
+		switch r.Status {
+		case validator.Invalid:
+			invalid++
+			for _, ve := range r.ValidationErrors {
+				results = append(results, fn.ConfigObjectResult(fmt.Sprintf("%s: %s", ve.Path, ve.Msg), o, fn.Error))
+			}
+		case validator.Error:
+			invalid++
+			results = append(results, fn.ConfigObjectResult(r.Err.Error(), o, fn.Error))
+		case validator.Skipped:
+			results = append(results, fn.ConfigObjectResult("skipped validation", o, fn.Warning))
+		case validator.Valid, validator.Empty:
+		}
+	}
+	if invalid > 0 {
+		return results, fmt.Errorf("%d invalid objects", invalid)
+	}
+	return results, nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package postrender
+
+import (
+	"os"
+	"testing"
+
+	"github.com/GoogleContainerTools/kpt-functions-sdk/go/fn"
+	t "github.com/krm-functions/catalog/pkg/helmspecs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostRenderers(tt *testing.T) {
+	objs, err := fn.ParseKubeObjects([]byte(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: cm
+  labels:
+    app: chart
+  annotations:
+    note: chart
+data:
+  foo: bar
+`))
+	if err != nil {
+		tt.Fatal(err)
+	}
+	renderers := []t.PostRenderer{
+		{Name: SetLabels, ConfigMap: map[string]string{"team": "blue"}},
+		{Name: SetAnnotations, ConfigMap: map[string]string{"owner": "someone"}},
+		{Name: Kubeconform, ConfigMap: map[string]string{"schema_locations": "../../examples/kubeconform/schema-bundle/"}},
+	}
+	objs, results, err := Run(renderers, objs)
+	assert.NoError(tt, err)
+	assert.Equal(tt, 0, len(results))
+	// Identical to the set-labels and set-annotations functions
+	assert.Equal(tt, map[string]string{"team": "blue"}, objs[0].GetLabels())
+	assert.Equal(tt, map[string]string{"owner": "someone"}, objs[0].GetAnnotations())
+
+	_, _, err = Run([]t.PostRenderer{{Name: "unknown"}}, objs)
+	assert.Error(tt, err)
+
+	_, _, err = Run([]t.PostRenderer{{Name: Kubeconform, ConfigMap: map[string]string{"kubernetes_version": "v1.30"}}}, objs)
+	assert.ErrorContains(tt, err, "illegal 'kubernetes_version' argument")
+}
+
+func TestKubeconformInvalid(tt *testing.T) {
+	b, err := os.ReadFile("../../examples/kubeconform/manifests/configmap.yaml")
+	if err != nil {
+		tt.Fatal(err)
+	}
+	objs, err := fn.ParseKubeObjects(b)
+	if err != nil {
+		tt.Fatal(err)
+	}
+	renderers := []t.PostRenderer{
+		{Name: Kubeconform, ConfigMap: map[string]string{"schema_locations": "../../examples/kubeconform/schema-bundle/"}},
+	}
+	_, results, err := Run(renderers, objs)
+	assert.Error(tt, err)
+	assert.Equal(tt, 2, len(results))
+	assert.Equal(tt, "invalid-nested-dict", results[0].ResourceRef.Name)
+}
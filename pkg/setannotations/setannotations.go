@@ -0,0 +1,54 @@
+// Copyright 2025 Michael Vittrup Larsen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Annotations of the set-annotations function, shared by the
+// set-annotations function and the set-annotations post-renderer
+package setannotations
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+type SetAnnotations struct {
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+func (fnCfg *SetAnnotations) LoadFunctionConfig(o *yaml.RNode) error {
+	if o.GetKind() == "ConfigMap" && o.GetApiVersion() == "v1" {
+		var cm corev1.ConfigMap
+		if err := yaml.Unmarshal([]byte(o.MustString()), &cm); err != nil {
+			return err
+		}
+		fnCfg.Annotations = cm.Data
+		return nil
+	} else if o.GetKind() == "SetAnnotations" && o.GetApiVersion() == "fn.kpt.dev/v1alpha1" {
+		if err := yaml.Unmarshal([]byte(o.MustString()), &fnCfg); err != nil {
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown function config")
+}
+
+// Filter sets the annotations of an object
+func (fnCfg *SetAnnotations) Filter(object *yaml.RNode) (*yaml.RNode, error) {
+	err := object.SetAnnotations(fnCfg.Annotations)
+	if err != nil {
+		return object, err
+	}
+	return object, nil
+}